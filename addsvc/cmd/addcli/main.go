@@ -1,44 +1,145 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"kitdemo/addsvc/pkg/addservice"
 	"kitdemo/addsvc/pkg/addtransport"
+	"kitdemo/pkg/filesd"
+	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 
+	kitjwt "github.com/go-kit/kit/auth/jwt"
 	"github.com/go-kit/kit/log"
+	"github.com/nats-io/nats.go"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func main() {
 	fs := flag.NewFlagSet("addcli", flag.ExitOnError)
 	var (
-		grpcAddr = fs.String("grpc-addr", "", "gRPC address of addsvc")
-		method   = fs.String("method", "sum", "sum, concat")
+		httpAddr = fs.String("http-addr", "", "HTTP address of addsvc")
+		grpcAddr = fs.String("grpc-addr", "", "Comma-separated gRPC addresses of addsvc instances")
+		grpcFile = fs.String("grpc-file", "", "JSON or YAML file listing gRPC addresses of addsvc instances, re-read when it changes")
+		retryMax = fs.Int("retry-max", 3, "Maximum attempts per call across gRPC instances")
+		retryTTL = fs.Duration("retry-timeout", 500*time.Millisecond, "Total time budget per call including retries")
+		natsURL  = fs.String("nats-url", "", "URL for connecting to NATS")
+		method   = fs.String("method", "sum", "sum, concat, sumstream (reads whitespace-separated integers from stdin, gRPC only), concatstream (reads \"a b\" lines from stdin, gRPC only)")
+		probe    = fs.Bool("health", false, "Check gRPC health of every -grpc-addr instance and exit non-zero if any is not serving")
+		list     = fs.Bool("list", false, "List services and methods of the first -grpc-addr instance via server reflection")
+		call     = fs.String("call", "", "Call any method (e.g. pb.Add/Sum) via server reflection with JSON input from the argument or stdin")
+		useTLS   = fs.Bool("tls", false, "Dial gRPC over TLS, implied by -tls-ca and -tls-cert")
+		tlsCert  = fs.String("tls-cert", "", "PEM client certificate presented for mutual TLS, reloaded when the file changes")
+		tlsKey   = fs.String("tls-key", "", "PEM private key for -tls-cert")
+		tlsCA    = fs.String("tls-ca", "", "PEM CA bundle used to verify the server, system roots if empty")
+		tlsName  = fs.String("tls-server-name", "", "Override the server name used to verify the server certificate")
+		token    = fs.String("token", "", "JWT sent as a bearer token with every request")
+		metrics  = fs.Bool("metrics", false, "Print client-side gRPC metrics to stderr after the call")
 	)
-	fs.Usage = usageFor(fs, os.Args[0]+" [flags] <a> <b>")
+	fs.Usage = usageFor(fs, os.Args[0]+" [flags] <a> <b>\n  "+os.Args[0]+" -method sumstream|concatstream [flags] < input\n  "+os.Args[0]+" -list|-call <service/method> [flags] [json]")
 	fs.Parse(os.Args[1:])
-	if len(fs.Args()) != 2 {
+	ctx := context.Background()
+	if *token != "" {
+		ctx = context.WithValue(ctx, kitjwt.JWTTokenContextKey, *token)
+	}
+	creds := grpc.WithInsecure()
+	if *useTLS || *tlsCA != "" || *tlsCert != "" {
+		tlsConfig, err := addtransport.NewClientTLSConfig(addtransport.TLSFiles{
+			CertFile: *tlsCert,
+			KeyFile:  *tlsKey,
+			CAFile:   *tlsCA,
+		}, *tlsName, log.NewNopLogger())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+	if *probe {
+		healthy := *grpcAddr != ""
+		for _, addr := range strings.Split(*grpcAddr, ",") {
+			addr = strings.TrimSpace(addr)
+			status, err := checkHealth(addr, creds)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s: %v\n", addr, err)
+			} else {
+				fmt.Fprintf(os.Stdout, "%s: %s\n", addr, status)
+			}
+			healthy = healthy && status == healthpb.HealthCheckResponse_SERVING
+		}
+		if !healthy {
+			os.Exit(1)
+		}
+		return
+	}
+	if *list || *call != "" {
+		if err := runReflection(ctx, strings.Split(*grpcAddr, ",")[0], creds, *list, *call, fs.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *method != "sumstream" && *method != "concatstream" && len(fs.Args()) != 2 {
 		fs.Usage()
 		os.Exit(1)
 	}
 	var (
-		svc addservice.Service
-		err error
+		svc           addservice.Service
+		conns         []*grpc.ClientConn
+		clientMetrics *addtransport.ClientMetrics
+		registry      *stdprometheus.Registry
+		err           error
 	)
-	if *grpcAddr != "" {
-		conn, err := grpc.Dial(*grpcAddr, grpc.WithInsecure(), grpc.WithTimeout(time.Second))
+	if *metrics {
+		registry = stdprometheus.NewRegistry()
+		if clientMetrics, err = addtransport.NewClientMetrics(registry); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *httpAddr != "" {
+		svc, err = addtransport.NewHTTPClient(*httpAddr, log.NewNopLogger())
+	} else if *grpcAddr != "" {
+		for _, addr := range strings.Split(*grpcAddr, ",") {
+			conn, err := grpc.Dial(strings.TrimSpace(addr), creds, grpc.WithTimeout(time.Second))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v", err)
+				os.Exit(1)
+			}
+			defer conn.Close()
+			conns = append(conns, conn)
+		}
+		svc = addtransport.NewBalancedGRPCClient(conns, *retryMax, *retryTTL, nil, nil, clientMetrics, log.NewNopLogger())
+	} else if *grpcFile != "" {
+		instancer, err := filesd.NewInstancer(*grpcFile, time.Second, log.NewNopLogger())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		defer instancer.Stop()
+		dial := func(instance string) (*grpc.ClientConn, error) {
+			return grpc.Dial(instance, creds, grpc.WithTimeout(time.Second))
+		}
+		svc = addtransport.NewInstancerGRPCClient(instancer, dial, *retryMax, *retryTTL, nil, nil, clientMetrics, log.NewNopLogger())
+	} else if *natsURL != "" {
+		nc, err := nats.Connect(*natsURL)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v", err)
 			os.Exit(1)
 		}
-		defer conn.Close()
-		svc = addtransport.NewGRPCClient(conn, log.NewNopLogger())
+		defer nc.Close()
+		svc = addtransport.NewNATSClient(nc, log.NewNopLogger())
 	} else {
 		fmt.Fprintf(os.Stderr, "error: no remote address specified\n")
 		os.Exit(1)
@@ -48,29 +149,147 @@ func main() {
 		os.Exit(1)
 	}
 
+	// 失败时也要打印 -metrics，错误数就在其中
+	exit := func(code int) {
+		if registry != nil {
+			printMetrics(os.Stderr, registry)
+		}
+		os.Exit(code)
+	}
 	switch *method {
 	case "sum":
 		a, _ := strconv.ParseInt(fs.Args()[0], 10, 64)
 		b, _ := strconv.ParseInt(fs.Args()[1], 10, 64)
-		v, err := svc.Sum(context.Background(), int(a), int(b))
+		v, err := svc.Sum(ctx, int(a), int(b))
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 		fmt.Fprintf(os.Stdout, "%d + %d = %d", a, b, v)
 	case "concat":
 		a := fs.Args()[0]
 		b := fs.Args()[1]
-		v, err := svc.Concat(context.Background(), a, b)
+		v, err := svc.Concat(ctx, a, b)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 		fmt.Fprintf(os.Stdout, "%q + %q = %q\n", a, b, v)
+	case "sumstream":
+		numbers, scanErr := scanInts(os.Stdin)
+		v, err := svc.SumStream(ctx, numbers)
+		if err == nil {
+			err = <-scanErr
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			exit(1)
+		}
+		fmt.Fprintf(os.Stdout, "sum = %d\n", v)
+	case "concatstream":
+		if len(conns) == 0 {
+			fmt.Fprintf(os.Stderr, "error: concatstream requires -grpc-addr\n")
+			os.Exit(1)
+		}
+		if err := concatStream(ctx, conns[0], os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
 	default:
 		fmt.Fprintf(os.Stderr, "Invalid Method Name")
 		os.Exit(1)
 	}
+	if registry != nil {
+		printMetrics(os.Stderr, registry)
+	}
+}
+
+//scanInts 逐个读取 r 中以空白分隔的整数并发送出去，读完或遇到非法输入时关闭 numbers
+//非法输入的错误在 numbers 关闭之前放到 errc 中
+func scanInts(r io.Reader) (<-chan int, <-chan error) {
+	numbers := make(chan int)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(numbers)
+		scanner := bufio.NewScanner(r)
+		scanner.Split(bufio.ScanWords)
+		for scanner.Scan() {
+			n, err := strconv.Atoi(scanner.Text())
+			if err != nil {
+				errc <- err
+				return
+			}
+			numbers <- n
+		}
+		errc <- scanner.Err()
+	}()
+	return numbers, errc
+}
+
+//concatStream 从 r 中逐行读取 "a b"，在一个流上连续发送，同时按顺序打印每个结果
+//单条消息的错误只打印出来，不会中断流
+func concatStream(ctx context.Context, conn *grpc.ClientConn, r io.Reader) error {
+	stream, err := addtransport.NewGRPCConcatStream(ctx, conn, nil)
+	if err != nil {
+		return err
+	}
+	sendErr := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			var a, b string
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 0 {
+				a = fields[0]
+			}
+			if len(fields) > 1 {
+				b = fields[1]
+			}
+			if err := stream.Send(a, b); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		stream.CloseSend()
+		sendErr <- scanner.Err()
+	}()
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return <-sendErr
+		}
+		if err != nil {
+			return err
+		}
+		if resp.Err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", resp.Err)
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "%q\n", resp.V)
+	}
+}
+
+//checkHealth 通过 grpc.health.v1.Health 查询 addr 上 pb.Add 服务的状态
+func checkHealth(addr string, creds grpc.DialOption) (healthpb.HealthCheckResponse_ServingStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, creds, grpc.WithBlock())
+	if err != nil {
+		return healthpb.HealthCheckResponse_UNKNOWN, err
+	}
+	defer conn.Close()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: "pb.Add"})
+	if err != nil {
+		return healthpb.HealthCheckResponse_UNKNOWN, err
+	}
+	return resp.Status, nil
+}
+
+//printMetrics 以 Prometheus 的文本格式打印 g 中的指标
+func printMetrics(w io.Writer, g stdprometheus.Gatherer) {
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(g, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	io.Copy(w, rec.Body)
 }
 
 func usageFor(fs *flag.FlagSet, short string) func() {
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	kitjwt "github.com/go-kit/kit/auth/jwt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+//runReflection list 为 true 时列出 addr 上的所有方法，否则调用 call 指定的方法
+func runReflection(ctx context.Context, addr string, creds grpc.DialOption, list bool, call string, args []string) error {
+	if addr == "" {
+		return errors.New("-list and -call require -grpc-addr")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, strings.TrimSpace(addr), creds, grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if list {
+		return listMethods(ctx, conn, os.Stdout)
+	}
+	return invokeMethod(ctx, conn, call, callInput(args), os.Stdout)
+}
+
+//reflectClient 通过 gRPC server reflection 获取服务的描述信息，不需要在编译时知道 .proto 文件
+type reflectClient struct {
+	stream rpb.ServerReflection_ServerReflectionInfoClient
+	// files 保存目前收到的所有文件描述，服务端在同一个流上不会重复发送已经发送过的依赖
+	files map[string]*descriptorpb.FileDescriptorProto
+}
+
+func newReflectClient(ctx context.Context, conn *grpc.ClientConn) (*reflectClient, error) {
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &reflectClient{stream: stream, files: map[string]*descriptorpb.FileDescriptorProto{}}, nil
+}
+
+func (c *reflectClient) roundTrip(req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+	if err := c.stream.Send(req); err != nil {
+		return nil, err
+	}
+	resp, err := c.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if e := resp.GetErrorResponse(); e != nil {
+		return nil, errors.New(e.ErrorMessage)
+	}
+	return resp, nil
+}
+
+//ListServices 返回服务端注册的所有服务名
+func (c *reflectClient) ListServices() ([]string, error) {
+	resp, err := c.roundTrip(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, s := range resp.GetListServicesResponse().GetService() {
+		names = append(names, s.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+//Service 取得定义 name 的文件及其依赖，返回服务的描述
+func (c *reflectClient) Service(name string) (protoreflect.ServiceDescriptor, error) {
+	resp, err := c.roundTrip(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: name},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+		fd := new(descriptorpb.FileDescriptorProto)
+		if err := proto.Unmarshal(b, fd); err != nil {
+			return nil, err
+		}
+		c.files[fd.GetName()] = fd
+	}
+
+	set := new(descriptorpb.FileDescriptorSet)
+	for _, fd := range c.files {
+		set.File = append(set.File, fd)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, err
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", name)
+	}
+	return sd, nil
+}
+
+//listMethods 打印所有服务和方法的签名
+func listMethods(ctx context.Context, conn *grpc.ClientConn, w io.Writer) error {
+	rc, err := newReflectClient(ctx, conn)
+	if err != nil {
+		return err
+	}
+	names, err := rc.ListServices()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		sd, err := rc.Service(name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", name)
+		methods := sd.Methods()
+		for i := 0; i < methods.Len(); i++ {
+			md := methods.Get(i)
+			fmt.Fprintf(w, "  %s(%s%s) returns (%s%s)\n",
+				md.Name(),
+				streamPrefix(md.IsStreamingClient()), md.Input().FullName(),
+				streamPrefix(md.IsStreamingServer()), md.Output().FullName(),
+			)
+		}
+	}
+	return nil
+}
+
+func streamPrefix(streaming bool) string {
+	if streaming {
+		return "stream "
+	}
+	return ""
+}
+
+//invokeMethod 调用 method(格式为 pb.Add/Sum)，请求是 r 中的 JSON，每个响应以 JSON 格式写到 w
+//客户端流式方法可以在 r 中连续写多个 JSON 对象，其他方法只使用第一个
+func invokeMethod(ctx context.Context, conn *grpc.ClientConn, method string, r io.Reader, w io.Writer) error {
+	i := strings.LastIndexAny(method, "/.")
+	if i <= 0 {
+		return fmt.Errorf("invalid method %q, want service/method", method)
+	}
+	service, name := strings.TrimPrefix(method[:i], "/"), method[i+1:]
+
+	rc, err := newReflectClient(ctx, conn)
+	if err != nil {
+		return err
+	}
+	sd, err := rc.Service(service)
+	if err != nil {
+		return err
+	}
+	md := sd.Methods().ByName(protoreflect.Name(name))
+	if md == nil {
+		return fmt.Errorf("service %s has no method %s", service, name)
+	}
+
+	requests, err := decodeJSONMessages(r, md.Input(), md.IsStreamingClient())
+	if err != nil {
+		return err
+	}
+	desc := &grpc.StreamDesc{
+		StreamName:    name,
+		ClientStreams: md.IsStreamingClient(),
+		ServerStreams: md.IsStreamingServer(),
+	}
+	// -token 指定的 JWT 只发送给被调用的方法，reflection 服务本身不需要认证
+	header := metadata.MD{}
+	ctx = metadata.NewOutgoingContext(kitjwt.ContextToGRPC()(ctx, &header), header)
+	stream, err := conn.NewStream(ctx, desc, "/"+service+"/"+name)
+	if err != nil {
+		return err
+	}
+	for _, req := range requests {
+		if err := stream.SendMsg(req); err != nil {
+			break // 真正的错误由 RecvMsg 返回
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	marshaler := protojson.MarshalOptions{Multiline: true, Indent: "  ", EmitUnpopulated: true}
+	for {
+		resp := dynamicpb.NewMessage(md.Output())
+		if err := stream.RecvMsg(resp); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		b, err := marshaler.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", b)
+	}
+}
+
+//decodeJSONMessages 将 r 中的 JSON 对象转换成 md 描述的消息，r 为空时发送一个空消息
+func decodeJSONMessages(r io.Reader, md protoreflect.MessageDescriptor, multiple bool) ([]proto.Message, error) {
+	var msgs []proto.Message
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		msg := dynamicpb.NewMessage(md)
+		if err := protojson.Unmarshal(raw, msg); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+		if !multiple {
+			break
+		}
+	}
+	if len(msgs) == 0 && !multiple {
+		msgs = append(msgs, dynamicpb.NewMessage(md))
+	}
+	return msgs, nil
+}
+
+// callInput 参数中的 JSON 优先，没有参数或者参数是 - 时从标准输入读取
+func callInput(args []string) io.Reader {
+	if len(args) == 0 || args[0] == "-" {
+		return os.Stdin
+	}
+	return strings.NewReader(strings.Join(args, " "))
+}
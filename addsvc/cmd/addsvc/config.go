@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"kitdemo/addsvc/pkg/addendpoint"
+	"kitdemo/addsvc/pkg/addservice"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// config 是 -config 指定的 YAML 配置文件，每一项都对应一个 flag，文件中没有出现的项保持 flag 的值
+// 收到 SIGHUP 时只重新加载 business 中的业务规则，其他的项需要重启服务才能生效
+type config struct {
+	Addresses struct {
+		Debug *string `yaml:"debug"`
+		HTTP  *string `yaml:"http"`
+		GRPC  *string `yaml:"grpc"`
+	} `yaml:"addresses"`
+	Limits struct {
+		RateLimit               *float64       `yaml:"rate_limit"`
+		RateBurst               *int           `yaml:"rate_burst"`
+		BreakerFailures         *uint          `yaml:"breaker_failures"`
+		BreakerTimeout          *time.Duration `yaml:"breaker_timeout"`
+		BreakerHalfOpenRequests *uint          `yaml:"breaker_half_open_requests"`
+	} `yaml:"limits"`
+	Business struct {
+		MaxConcatLength *int  `yaml:"max_concat_length"`
+		IntMax          *int  `yaml:"int_max"`
+		RejectZero      *bool `yaml:"reject_zero"`
+	} `yaml:"business"`
+}
+
+func loadConfig(path string) (config, error) {
+	var c config
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// flags 返回配置文件中出现的项对应的 flag 名和值
+func (c config) flags() map[string]string {
+	m := map[string]string{}
+	if c.Addresses.Debug != nil {
+		m["debug-addr"] = *c.Addresses.Debug
+	}
+	if c.Addresses.HTTP != nil {
+		m["http-addr"] = *c.Addresses.HTTP
+	}
+	if c.Addresses.GRPC != nil {
+		m["grpc-addr"] = *c.Addresses.GRPC
+	}
+	if c.Limits.RateLimit != nil {
+		m["rate-limit"] = fmt.Sprint(*c.Limits.RateLimit)
+	}
+	if c.Limits.RateBurst != nil {
+		m["rate-burst"] = fmt.Sprint(*c.Limits.RateBurst)
+	}
+	if c.Limits.BreakerFailures != nil {
+		m["breaker-failures"] = fmt.Sprint(*c.Limits.BreakerFailures)
+	}
+	if c.Limits.BreakerTimeout != nil {
+		m["breaker-timeout"] = c.Limits.BreakerTimeout.String()
+	}
+	if c.Limits.BreakerHalfOpenRequests != nil {
+		m["breaker-half-open-requests"] = fmt.Sprint(*c.Limits.BreakerHalfOpenRequests)
+	}
+	if c.Business.MaxConcatLength != nil {
+		m["max-concat-length"] = fmt.Sprint(*c.Business.MaxConcatLength)
+	}
+	if c.Business.IntMax != nil {
+		m["int-max"] = fmt.Sprint(*c.Business.IntMax)
+	}
+	if c.Business.RejectZero != nil {
+		m["reject-zero"] = fmt.Sprint(*c.Business.RejectZero)
+	}
+	return m
+}
+
+// business 用配置文件中出现的业务规则替换 base 中对应的值，explicit 中的 flag 是在命令行中指定的，优先级更高
+func (c config) business(base addservice.Limits, explicit map[string]bool) addservice.Limits {
+	if c.Business.MaxConcatLength != nil && !explicit["max-concat-length"] {
+		base.MaxLen = *c.Business.MaxConcatLength
+	}
+	if c.Business.IntMax != nil && !explicit["int-max"] {
+		base.IntMax = *c.Business.IntMax
+	}
+	if c.Business.RejectZero != nil && !explicit["reject-zero"] {
+		base.RejectZero = *c.Business.RejectZero
+	}
+	return base
+}
+
+// explicitFlags 返回已经设置过的 flag，需要在 applyConfig 之前调用
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	return explicit
+}
+
+// applyConfig 配置文件中的值覆盖 flag 的默认值，explicit 中的 flag 是在命令行中指定的，优先级更高
+func applyConfig(fs *flag.FlagSet, c config, explicit map[string]bool) error {
+	for name, value := range c.flags() {
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// validateEndpointLimits 开启限流时令牌桶的容量必须大于 0，否则所有请求都会被拒绝
+func validateEndpointLimits(l addendpoint.Limits) error {
+	if l.RPS < 0 {
+		return fmt.Errorf("rate-limit must not be negative, got %v", l.RPS)
+	}
+	if l.RPS > 0 && l.Burst <= 0 {
+		return fmt.Errorf("rate-burst must be positive when rate-limit is set, got %d", l.Burst)
+	}
+	return nil
+}
+
+func validateLimits(l addservice.Limits) error {
+	if l.MaxLen < 0 {
+		return fmt.Errorf("max-concat-length must not be negative, got %d", l.MaxLen)
+	}
+	if l.IntMax <= 0 {
+		return fmt.Errorf("int-max must be positive, got %d", l.IntMax)
+	}
+	return nil
+}
+
+// diffLimits 返回发生变化的业务规则，用于记录日志
+func diffLimits(prev, next addservice.Limits) []interface{} {
+	var keyvals []interface{}
+	if prev.MaxLen != next.MaxLen {
+		keyvals = append(keyvals, "max_concat_length", fmt.Sprintf("%d -> %d", prev.MaxLen, next.MaxLen))
+	}
+	if prev.IntMax != next.IntMax {
+		keyvals = append(keyvals, "int_max", fmt.Sprintf("%d -> %d", prev.IntMax, next.IntMax))
+	}
+	if prev.RejectZero != next.RejectZero {
+		keyvals = append(keyvals, "reject_zero", fmt.Sprintf("%t -> %t", prev.RejectZero, next.RejectZero))
+	}
+	if len(keyvals) == 0 {
+		keyvals = append(keyvals, "changed", "none")
+	}
+	return keyvals
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"kitdemo/addsvc/pkg/addendpoint"
+	"kitdemo/addsvc/pkg/addservice"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestValidateEndpointLimits(t *testing.T) {
+	for _, tc := range []struct {
+		limits addendpoint.Limits
+		ok     bool
+	}{
+		{addendpoint.Limits{}, true},
+		{addendpoint.Limits{RPS: 0, Burst: 0}, true},
+		{addendpoint.Limits{RPS: 100, Burst: 100}, true},
+		{addendpoint.Limits{RPS: 100, Burst: 0}, false},
+		{addendpoint.Limits{RPS: -1, Burst: 10}, false},
+	} {
+		if err := validateEndpointLimits(tc.limits); (err == nil) != tc.ok {
+			t.Errorf("%+v: want ok=%t, have %v", tc.limits, tc.ok, err)
+		}
+	}
+}
+
+func TestReloadBusinessLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addsvc.yaml")
+	write := func(s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := addservice.Limits{MaxLen: 10, IntMax: 100, RejectZero: true}
+	explicit := map[string]bool{"reject-zero": true}
+	store := addservice.NewLimitsStore(base)
+
+	write("business:\n  max_concat_length: 20\n  int_max: 200\n  reject_zero: false\n")
+	reloadBusinessLimits(path, base, explicit, store, log.NewNopLogger())
+	if want, have := (addservice.Limits{MaxLen: 20, IntMax: 200, RejectZero: true}), store.Load(); want != have {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+
+	// 删除的项恢复成 flag 的值
+	write("business:\n  max_concat_length: 30\n")
+	reloadBusinessLimits(path, base, explicit, store, log.NewNopLogger())
+	if want, have := (addservice.Limits{MaxLen: 30, IntMax: 100, RejectZero: true}), store.Load(); want != have {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+
+	// 无效的配置不会替换当前的规则
+	write("business:\n  max_concat_length: -1\n")
+	reloadBusinessLimits(path, base, explicit, store, log.NewNopLogger())
+	if want, have := (addservice.Limits{MaxLen: 30, IntMax: 100, RejectZero: true}), store.Load(); want != have {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	kitgrpc "github.com/go-kit/kit/transport/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+)
+
+//drainer 优雅退出：先把健康检查设置为 NOT_SERVING，等待 delay 让负载均衡器发现后不再转发新的请求，
+//然后同时关闭所有的监听，一起等待正在处理的请求完成，总共最多等待 timeout
+//oklog/group 会依次调用每个 actor 的 interrupt，所有的 interrupt 都调用 Drain，只有第一次调用会执行
+type drainer struct {
+	health  *health.Server
+	delay   time.Duration
+	timeout time.Duration
+	logger  log.Logger
+
+	once   sync.Once
+	drains []func(ctx context.Context)
+}
+
+//Add 添加一个监听的关闭函数，ctx 到期后需要强制关闭，必须在 Drain 之前调用
+func (d *drainer) Add(drain func(ctx context.Context)) {
+	d.drains = append(d.drains, drain)
+}
+
+//Drain 执行优雅退出，所有的关闭函数返回后才返回
+func (d *drainer) Drain() {
+	d.once.Do(func() {
+		d.health.Shutdown()
+		d.logger.Log("during", "drain", "health", "NOT_SERVING", "delay", d.delay)
+		time.Sleep(d.delay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		defer cancel()
+		var wg sync.WaitGroup
+		for _, drain := range d.drains {
+			wg.Add(1)
+			go func(drain func(ctx context.Context)) {
+				defer wg.Done()
+				drain(ctx)
+			}(drain)
+		}
+		wg.Wait()
+	})
+}
+
+// inflight 统计正在处理中的请求数，优雅退出时用来记录等待完成了多少请求
+type inflight struct {
+	n int64
+}
+
+func (f *inflight) Count() int64 {
+	return atomic.LoadInt64(&f.n)
+}
+
+//UnaryInterceptor 统计 gRPC 请求，然后交给 kitgrpc.Interceptor 处理
+func (f *inflight) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	atomic.AddInt64(&f.n, 1)
+	defer atomic.AddInt64(&f.n, -1)
+	return kitgrpc.Interceptor(ctx, req, info, handler)
+}
+
+//StreamInterceptor 统计流式 gRPC 请求，一个流从建立到结束算作一个请求
+func (f *inflight) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	atomic.AddInt64(&f.n, 1)
+	defer atomic.AddInt64(&f.n, -1)
+	return handler(srv, ss)
+}
+
+//Handler 统计 HTTP 请求
+func (f *inflight) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&f.n, 1)
+		defer atomic.AddInt64(&f.n, -1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+//gracefulStopGRPC 不再接受新的请求，等待正在处理的请求完成，ctx 到期后强制关闭
+func gracefulStopGRPC(ctx context.Context, s *grpc.Server, f *inflight, logger log.Logger) {
+	pending := f.Count()
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logger.Log("transport", "gRPC", "during", "GracefulStop", "drained", pending)
+	case <-ctx.Done():
+		aborted := f.Count()
+		s.Stop()
+		logger.Log("transport", "gRPC", "during", "GracefulStop", "drained", pending-aborted, "aborted", aborted)
+	}
+}
+
+//shutdownHTTP 关闭监听，等待正在处理的请求完成，ctx 到期后强制关闭
+func shutdownHTTP(ctx context.Context, s *http.Server, transport string, f *inflight, logger log.Logger) {
+	pending := f.Count()
+	if err := s.Shutdown(ctx); err != nil {
+		aborted := f.Count()
+		s.Close()
+		logger.Log("transport", transport, "during", "Shutdown", "drained", pending-aborted, "aborted", aborted, "err", err)
+		return
+	}
+	logger.Log("transport", transport, "during", "Shutdown", "drained", pending)
+}
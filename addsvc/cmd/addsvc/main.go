@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"kitdemo/addsvc/pkg/addendpoint"
@@ -12,27 +13,83 @@ import (
 	"os/signal"
 	"syscall"
 	"text/tabwriter"
+	"time"
 
 	addpb "kitdemo/addsvc/pb"
 
+	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
 	"github.com/go-kit/kit/metrics/prometheus"
-	kitgrpc "github.com/go-kit/kit/transport/grpc"
+	"github.com/nats-io/nats.go"
 	"github.com/oklog/oklog/pkg/group"
+	"github.com/openzipkin/zipkin-go"
+	"github.com/openzipkin/zipkin-go/reporter"
+	zipkinhttp "github.com/openzipkin/zipkin-go/reporter/http"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 func main() {
 	fs := flag.NewFlagSet("addsvc", flag.ExitOnError)
 	var (
 		debugAddr = fs.String("debug-addr", ":8080", "Debug and metrics listen address")
+		httpAddr  = fs.String("http-addr", ":8081", "HTTP listen address")
 		grpcAddr  = fs.String("grpc-addr", ":8082", "gRPC Listen Address")
+		natsURL   = fs.String("nats-url", "", "URL for connecting to NATS, empty to disable")
+		natsQueue = fs.String("nats-queue", "addsvc", "NATS queue group shared by all workers")
+		drainWait = fs.Duration("drain-timeout", 10*time.Second, "How long all listeners together wait for in-flight requests on shutdown before closing connections")
+		drainWarn = fs.Duration("drain-delay", 5*time.Second, "How long to report NOT_SERVING on shutdown before draining, so load balancers stop sending new requests")
+		rateLimit = fs.Float64("rate-limit", 100, "Requests per second allowed for each method, 0 to disable")
+		rateBurst = fs.Int("rate-burst", 100, "Maximum burst size of the rate limiter")
+		brkFails  = fs.Uint("breaker-failures", 5, "Consecutive failures that trip the circuit breaker")
+		brkWait   = fs.Duration("breaker-timeout", 60*time.Second, "How long the circuit breaker stays open before half-open")
+		brkProbes = fs.Uint("breaker-half-open-requests", 1, "Requests allowed through while the circuit breaker is half-open")
+		otlpAddr  = fs.String("otlp-addr", "", "Enable OpenTelemetry tracing via OTLP/gRPC exporter to this collector address e.g. localhost:4317")
+		zipkinURL = fs.String("zipkin-url", "", "Enable Zipkin tracing via HTTP reporter URL e.g. http://localhost:9411/api/v2/spans")
+		tlsCert   = fs.String("tls-cert", "", "Serve gRPC over TLS with this PEM certificate, reloaded when the file changes")
+		tlsKey    = fs.String("tls-key", "", "PEM private key for -tls-cert")
+		tlsCA     = fs.String("tls-ca", "", "PEM CA bundle used to verify client certificates")
+		tlsVerify = fs.Bool("tls-verify-client", false, "Require clients to present a certificate signed by -tls-ca (mutual TLS)")
+		jwtKey    = fs.String("jwt-key-file", "", "Require a JWT on every request, verified with the HMAC secret or PEM RSA public key in this file")
+		jwtAlg    = fs.String("jwt-alg", "HS256", "JWT signing algorithm, HS256/384/512 or RS256/384/512")
+		jwtAud    = fs.String("jwt-audience", "", "Required JWT audience, empty to skip the check")
+		jwtIss    = fs.String("jwt-issuer", "", "Required JWT issuer, empty to skip the check")
+		maxLen    = fs.Int("max-concat-length", addservice.DefaultLimits().MaxLen, "Maximum length of a Concat result")
+		intMax    = fs.Int("int-max", addservice.DefaultLimits().IntMax, "Largest Sum result before ErrIntOverflow, the smallest is -int-max-1")
+		rejZero   = fs.Bool("reject-zero", addservice.DefaultLimits().RejectZero, "Reject Sum operands that are zero")
+		cfgFile   = fs.String("config", "", "YAML config file, flags given on the command line take precedence; SIGHUP reloads its business section")
 	)
 	fs.Usage = usageFor(fs, os.Args[0]+" [flags] ")
 	fs.Parse(os.Args[1:])
+	// 命令行中指定的 flag 优先于配置文件，包括重新加载的时候
+	explicit := explicitFlags(fs)
+	// 重新加载时以配置文件之外的值为基础，这样从配置文件中删除的项会恢复成 flag 的值
+	flagBusiness := addservice.Limits{
+		MaxLen:     *maxLen,
+		IntMax:     *intMax,
+		RejectZero: *rejZero,
+	}
+	if *cfgFile != "" {
+		c, err := loadConfig(*cfgFile)
+		if err == nil {
+			err = applyConfig(fs, c, explicit)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "config %s: %v\n", *cfgFile, err)
+			os.Exit(1)
+		}
+	}
 
 	var logger log.Logger
 	{
@@ -40,6 +97,33 @@ func main() {
 		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
 		logger = log.With(logger, "caller", log.DefaultCaller)
 	}
+	var otelTracer trace.Tracer
+	{
+		if *otlpAddr != "" {
+			tp, err := newOTelTracerProvider(context.Background(), *otlpAddr, "addsvc")
+			if err != nil {
+				logger.Log("tracer", "OpenTelemetry", "err", err)
+				os.Exit(1)
+			}
+			defer tp.Shutdown(context.Background())
+			otelTracer = tp.Tracer("kitdemo/addsvc")
+			logger.Log("tracer", "OpenTelemetry", "addr", *otlpAddr)
+		}
+	}
+	var zipkinTracer *zipkin.Tracer
+	{
+		if *zipkinURL != "" {
+			reporter := zipkinhttp.NewReporter(*zipkinURL)
+			defer reporter.Close()
+			tracer, err := newZipkinTracer(reporter, "addsvc", *grpcAddr)
+			if err != nil {
+				logger.Log("tracer", "Zipkin", "err", err)
+				os.Exit(1)
+			}
+			zipkinTracer = tracer
+			logger.Log("tracer", "Zipkin", "URL", *zipkinURL)
+		}
+	}
 	var ints, chars metrics.Counter
 	{
 		ints = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
@@ -64,14 +148,77 @@ func main() {
 			Help:      "请求的总耗时",
 		}, []string{"method", "success"})
 	}
+	var breakerState metrics.Gauge
+	{
+		breakerState = prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "example",
+			Subsystem: "addsvc",
+			Name:      "circuit_breaker_state",
+			Help:      "熔断器的状态，0 关闭，1 半开，2 打开",
+		}, []string{"method"})
+	}
 	http.DefaultServeMux.Handle("/metrics", promhttp.Handler())
 
+	limits := addendpoint.Limits{
+		RPS:                 *rateLimit,
+		Burst:               *rateBurst,
+		BreakerFailures:     uint32(*brkFails),
+		BreakerTimeout:      *brkWait,
+		BreakerHalfOpenReqs: uint32(*brkProbes),
+	}
+	if err := validateEndpointLimits(limits); err != nil {
+		logger.Log("config", "limits", "err", err)
+		os.Exit(1)
+	}
+
+	var auth endpoint.Middleware
+	{
+		if *jwtKey != "" {
+			mw, err := addendpoint.NewJWTMiddleware(addendpoint.JWTConfig{
+				Algorithm: *jwtAlg,
+				KeyFile:   *jwtKey,
+				Audience:  *jwtAud,
+				Issuer:    *jwtIss,
+			})
+			if err != nil {
+				logger.Log("auth", "JWT", "err", err)
+				os.Exit(1)
+			}
+			auth = mw
+			logger.Log("auth", "JWT", "alg", *jwtAlg)
+			if *natsURL != "" {
+				// NATS 消息没有 header，无法携带 token
+				logger.Log("auth", "JWT", "warning", "NATS requests carry no token and will be rejected")
+			}
+		}
+	}
+
+	business := addservice.Limits{
+		MaxLen:     *maxLen,
+		IntMax:     *intMax,
+		RejectZero: *rejZero,
+	}
+	if err := validateLimits(business); err != nil {
+		logger.Log("config", "business", "err", err)
+		os.Exit(1)
+	}
+	businessLimits := addservice.NewLimitsStore(business)
+
 	var (
-		service    = addservice.New(logger, ints, chars)
-		endpoints  = addendpoint.New(service, logger, duration)
-		grpcServer = addtransport.NewGRPCServer(endpoints, logger)
+		service     = addservice.New(logger, ints, chars, otelTracer, businessLimits)
+		endpoints   = addendpoint.New(service, logger, duration, breakerState, limits, auth, otelTracer, zipkinTracer)
+		httpHandler = addtransport.NewHTTPHandler(endpoints, logger)
+		grpcServer  = addtransport.NewGRPCServer(endpoints, otelTracer, zipkinTracer, logger)
+		// healthServer 实现了 grpc.health.v1.Health，负载均衡器通过它探测服务是否可用
+		healthServer = health.NewServer()
 	)
 
+	drain := &drainer{
+		health:  healthServer,
+		delay:   *drainWarn,
+		timeout: *drainWait,
+		logger:  logger,
+	}
 	var g group.Group
 	{
 		debugListenner, err := net.Listen("tcp", *debugAddr)
@@ -79,11 +226,34 @@ func main() {
 			logger.Log("transport", "debug/HTTP", "addr", *debugAddr)
 			os.Exit(1)
 		}
+		var debugInflight inflight
+		debugServer := &http.Server{Handler: debugInflight.Handler(http.DefaultServeMux)}
+		drain.Add(func(ctx context.Context) {
+			shutdownHTTP(ctx, debugServer, "debug/HTTP", &debugInflight, logger)
+		})
 		g.Add(func() error {
 			logger.Log("transport", "debug/HTTP", "addr", *debugAddr)
-			return http.Serve(debugListenner, http.DefaultServeMux)
+			return debugServer.Serve(debugListenner)
 		}, func(err error) {
-			debugListenner.Close()
+			drain.Drain()
+		})
+	}
+	{
+		httpListener, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			logger.Log("transport", "HTTP", "during", "Listen", "err", err)
+			os.Exit(1)
+		}
+		var httpInflight inflight
+		httpServer := &http.Server{Handler: httpInflight.Handler(httpHandler)}
+		drain.Add(func(ctx context.Context) {
+			shutdownHTTP(ctx, httpServer, "HTTP", &httpInflight, logger)
+		})
+		g.Add(func() error {
+			logger.Log("transport", "HTTP", "addr", *httpAddr)
+			return httpServer.Serve(httpListener)
+		}, func(err error) {
+			drain.Drain()
 		})
 	}
 	{
@@ -92,13 +262,72 @@ func main() {
 			logger.Log("transport", "gRPC", "during", "Listen", "err", err)
 			os.Exit(1)
 		}
+		var grpcInflight inflight
+		grpcOptions := []grpc.ServerOption{
+			grpc.UnaryInterceptor(grpcInflight.UnaryInterceptor),
+			grpc.StreamInterceptor(grpcInflight.StreamInterceptor),
+		}
+		if *tlsCert != "" {
+			tlsConfig, err := addtransport.NewServerTLSConfig(addtransport.TLSFiles{
+				CertFile: *tlsCert,
+				KeyFile:  *tlsKey,
+				CAFile:   *tlsCA,
+			}, *tlsVerify, log.With(logger, "transport", "gRPC"))
+			if err != nil {
+				logger.Log("transport", "gRPC", "during", "TLS", "err", err)
+				os.Exit(1)
+			}
+			grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(tlsConfig)))
+			logger.Log("transport", "gRPC", "tls", true, "verify_client", *tlsVerify)
+		}
+		baseServer := grpc.NewServer(grpcOptions...)
+		drain.Add(func(ctx context.Context) {
+			gracefulStopGRPC(ctx, baseServer, &grpcInflight, logger)
+		})
 		g.Add(func() error {
 			logger.Log("transport", "gRPC", "addr", *grpcAddr)
-			baseServer := grpc.NewServer(grpc.UnaryInterceptor(kitgrpc.Interceptor))
 			addpb.RegisterAddServer(baseServer, grpcServer)
+			healthpb.RegisterHealthServer(baseServer, healthServer)
+			// 开启 server reflection，addcli 等工具不需要 .proto 文件就可以列出和调用所有方法
+			reflection.Register(baseServer)
+			// 空字符串表示整个服务器的状态
+			healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+			healthServer.SetServingStatus("pb.Add", healthpb.HealthCheckResponse_SERVING)
 			return baseServer.Serve(grpcListener)
 		}, func(err error) {
-			grpcListener.Close()
+			drain.Drain()
+		})
+	}
+	if *natsURL != "" {
+		closed := make(chan struct{})
+		nc, err := nats.Connect(*natsURL, nats.ClosedHandler(func(*nats.Conn) { close(closed) }))
+		if err != nil {
+			logger.Log("transport", "NATS", "during", "Connect", "err", err)
+			os.Exit(1)
+		}
+		natsServer := addtransport.NewNATSServer(endpoints, logger)
+		cancelNATS := make(chan struct{})
+		// Drain 先处理完已经收到的消息，再取消所有订阅并关闭连接
+		drain.Add(func(ctx context.Context) {
+			close(cancelNATS)
+			nc.Drain()
+			select {
+			case <-closed:
+				logger.Log("transport", "NATS", "during", "Drain")
+			case <-ctx.Done():
+				nc.Close()
+				logger.Log("transport", "NATS", "during", "Drain", "err", ctx.Err())
+			}
+		})
+		g.Add(func() error {
+			logger.Log("transport", "NATS", "url", *natsURL, "queue", *natsQueue)
+			if _, err := natsServer.Subscribe(nc, *natsQueue); err != nil {
+				return err
+			}
+			<-cancelNATS
+			return nil
+		}, func(err error) {
+			drain.Drain()
 		})
 	}
 	{
@@ -116,9 +345,77 @@ func main() {
 			close(cancelInterrupt)
 		})
 	}
+	if *cfgFile != "" {
+		// 重新加载业务规则只是替换 businessLimits 中的值，不影响已经建立的连接
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		cancelReload := make(chan struct{})
+		g.Add(func() error {
+			for {
+				select {
+				case <-hup:
+					reloadBusinessLimits(*cfgFile, flagBusiness, explicit, businessLimits, logger)
+				case <-cancelReload:
+					return nil
+				}
+			}
+		}, func(err error) {
+			signal.Stop(hup)
+			close(cancelReload)
+		})
+	}
 	logger.Log("exit", g.Run())
 }
 
+// reloadBusinessLimits 重新读取配置文件中的业务规则，文件中没有的项使用 base 中的值，出错时继续使用原来的规则
+func reloadBusinessLimits(path string, base addservice.Limits, explicit map[string]bool, store *addservice.LimitsStore, logger log.Logger) {
+	c, err := loadConfig(path)
+	if err != nil {
+		logger.Log("config", path, "during", "reload", "err", err)
+		return
+	}
+	prev := store.Load()
+	next := c.business(base, explicit)
+	if err := validateLimits(next); err != nil {
+		logger.Log("config", path, "during", "reload", "err", err)
+		return
+	}
+	store.Store(next)
+	logger.Log(append([]interface{}{"config", path, "during", "reload"}, diffLimits(prev, next)...)...)
+}
+
+// newOTelTracerProvider 通过 OTLP/gRPC 将 span 批量发送给 addr 上的 collector
+// 测试时可以在进程内启动一个实现了 OTLP TraceService 的 gRPC 服务代替 collector
+func newOTelTracerProvider(ctx context.Context, addr, serviceName string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracegrpc.New(ctx,
+		otlptracegrpc.WithEndpoint(addr),
+		otlptracegrpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+		)),
+	), nil
+}
+
+// newZipkinTracer reporter 可以替换，比如测试中使用 recorder.NewReporter() 把 span 记录在内存中
+func newZipkinTracer(reporter reporter.Reporter, serviceName, hostPort string) (*zipkin.Tracer, error) {
+	// 只指定了端口的监听地址(比如 :8082)没法解析出 IP，默认使用 localhost
+	if host, port, err := net.SplitHostPort(hostPort); err == nil && host == "" {
+		hostPort = net.JoinHostPort("localhost", port)
+	}
+	zEP, err := zipkin.NewEndpoint(serviceName, hostPort)
+	if err != nil {
+		return nil, err
+	}
+	return zipkin.NewTracer(reporter, zipkin.WithLocalEndpoint(zEP))
+}
+
 func usageFor(fs *flag.FlagSet, short string) func() {
 	return func() {
 		fmt.Fprintf(os.Stderr, "Usage\n")
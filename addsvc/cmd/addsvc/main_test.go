@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+)
+
+// fakeCollector 进程内代替 OTLP collector，把收到的 span 发到 spans 中
+type fakeCollector struct {
+	coltracepb.UnimplementedTraceServiceServer
+	spans chan *tracepb.ResourceSpans
+}
+
+func (c *fakeCollector) Export(_ context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	for _, rs := range req.ResourceSpans {
+		c.spans <- rs
+	}
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+func TestOTelTracerProviderExportsToCollector(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := &fakeCollector{spans: make(chan *tracepb.ResourceSpans, 10)}
+	server := grpc.NewServer()
+	coltracepb.RegisterTraceServiceServer(server, collector)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tp, err := newOTelTracerProvider(ctx, lis.Addr().String(), "addsvc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Shutdown(context.Background())
+	_, span := tp.Tracer("test").Start(ctx, "Sum")
+	span.End()
+	if err := tp.ForceFlush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var rs *tracepb.ResourceSpans
+	select {
+	case rs = <-collector.spans:
+	case <-ctx.Done():
+		t.Fatal("collector received no spans")
+	}
+	var service string
+	for _, attr := range rs.Resource.Attributes {
+		if attr.Key == "service.name" {
+			service = attr.Value.GetStringValue()
+		}
+	}
+	if want, have := "addsvc", service; want != have {
+		t.Errorf("service.name: want %q, have %q", want, have)
+	}
+	var names []string
+	for _, ss := range rs.ScopeSpans {
+		for _, s := range ss.Spans {
+			names = append(names, s.Name)
+		}
+	}
+	if len(names) != 1 || names[0] != "Sum" {
+		t.Errorf("want one Sum span, have %v", names)
+	}
+}
@@ -24,6 +24,41 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
+// ErrorCode 业务错误码，客户端根据它还原 addservice 中定义的错误
+type ErrorCode int32
+
+const (
+	ErrorCode_OK                ErrorCode = 0
+	ErrorCode_UNKNOWN           ErrorCode = 1
+	ErrorCode_ZERO_PARA         ErrorCode = 2
+	ErrorCode_INT_OVERFLOW      ErrorCode = 3
+	ErrorCode_MAX_SIZE_EXCEEDED ErrorCode = 4
+)
+
+var ErrorCode_name = map[int32]string{
+	0: "OK",
+	1: "UNKNOWN",
+	2: "ZERO_PARA",
+	3: "INT_OVERFLOW",
+	4: "MAX_SIZE_EXCEEDED",
+}
+
+var ErrorCode_value = map[string]int32{
+	"OK":                0,
+	"UNKNOWN":           1,
+	"ZERO_PARA":         2,
+	"INT_OVERFLOW":      3,
+	"MAX_SIZE_EXCEEDED": 4,
+}
+
+func (x ErrorCode) String() string {
+	return proto.EnumName(ErrorCode_name, int32(x))
+}
+
+func (ErrorCode) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_174367f558d60c26, []int{0}
+}
+
 type SumRequest struct {
 	A                    int64    `protobuf:"varint,1,opt,name=a,proto3" json:"a,omitempty"`
 	B                    int64    `protobuf:"varint,2,opt,name=b,proto3" json:"b,omitempty"`
@@ -72,11 +107,12 @@ func (m *SumRequest) GetB() int64 {
 }
 
 type SumReply struct {
-	V                    int64    `protobuf:"varint,1,opt,name=v,proto3" json:"v,omitempty"`
-	Err                  string   `protobuf:"bytes,2,opt,name=err,proto3" json:"err,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	V                    int64     `protobuf:"varint,1,opt,name=v,proto3" json:"v,omitempty"`
+	Err                  string    `protobuf:"bytes,2,opt,name=err,proto3" json:"err,omitempty"`
+	Code                 ErrorCode `protobuf:"varint,3,opt,name=code,proto3,enum=pb.ErrorCode" json:"code,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
 }
 
 func (m *SumReply) Reset()         { *m = SumReply{} }
@@ -118,6 +154,13 @@ func (m *SumReply) GetErr() string {
 	return ""
 }
 
+func (m *SumReply) GetCode() ErrorCode {
+	if m != nil {
+		return m.Code
+	}
+	return ErrorCode_OK
+}
+
 type ConcatRequest struct {
 	A                    string   `protobuf:"bytes,1,opt,name=a,proto3" json:"a,omitempty"`
 	B                    string   `protobuf:"bytes,2,opt,name=b,proto3" json:"b,omitempty"`
@@ -166,11 +209,12 @@ func (m *ConcatRequest) GetB() string {
 }
 
 type ConcatReply struct {
-	V                    string   `protobuf:"bytes,1,opt,name=v,proto3" json:"v,omitempty"`
-	Err                  string   `protobuf:"bytes,2,opt,name=err,proto3" json:"err,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	V                    string    `protobuf:"bytes,1,opt,name=v,proto3" json:"v,omitempty"`
+	Err                  string    `protobuf:"bytes,2,opt,name=err,proto3" json:"err,omitempty"`
+	Code                 ErrorCode `protobuf:"varint,3,opt,name=code,proto3,enum=pb.ErrorCode" json:"code,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
 }
 
 func (m *ConcatReply) Reset()         { *m = ConcatReply{} }
@@ -212,7 +256,15 @@ func (m *ConcatReply) GetErr() string {
 	return ""
 }
 
+func (m *ConcatReply) GetCode() ErrorCode {
+	if m != nil {
+		return m.Code
+	}
+	return ErrorCode_OK
+}
+
 func init() {
+	proto.RegisterEnum("pb.ErrorCode", ErrorCode_name, ErrorCode_value)
 	proto.RegisterType((*SumRequest)(nil), "pb.SumRequest")
 	proto.RegisterType((*SumReply)(nil), "pb.SumReply")
 	proto.RegisterType((*ConcatRequest)(nil), "pb.ConcatRequest")
@@ -222,20 +274,28 @@ func init() {
 func init() { proto.RegisterFile("addsvc.proto", fileDescriptor_174367f558d60c26) }
 
 var fileDescriptor_174367f558d60c26 = []byte{
-	// 197 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x49, 0x4c, 0x49, 0x29,
-	0x2e, 0x4b, 0xd6, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x2a, 0x48, 0x52, 0xd2, 0xe0, 0xe2,
-	0x0a, 0x2e, 0xcd, 0x0d, 0x4a, 0x2d, 0x2c, 0x4d, 0x2d, 0x2e, 0x11, 0xe2, 0xe1, 0x62, 0x4c, 0x94,
-	0x60, 0x54, 0x60, 0xd4, 0x60, 0x0e, 0x62, 0x4c, 0x04, 0xf1, 0x92, 0x24, 0x98, 0x20, 0xbc, 0x24,
-	0x25, 0x2d, 0x2e, 0x0e, 0xb0, 0xca, 0x82, 0x9c, 0x4a, 0x90, 0x4c, 0x19, 0x4c, 0x5d, 0x99, 0x90,
-	0x00, 0x17, 0x73, 0x6a, 0x51, 0x11, 0x58, 0x25, 0x67, 0x10, 0x88, 0xa9, 0xa4, 0xcd, 0xc5, 0xeb,
-	0x9c, 0x9f, 0x97, 0x9c, 0x58, 0x82, 0x61, 0x30, 0x27, 0x8a, 0xc1, 0x9c, 0x20, 0x83, 0x75, 0xb9,
-	0xb8, 0x61, 0x8a, 0x51, 0xcc, 0xe6, 0xc4, 0x6a, 0xb6, 0x51, 0x0c, 0x17, 0xb3, 0x63, 0x4a, 0x8a,
-	0x90, 0x2a, 0x17, 0x73, 0x70, 0x69, 0xae, 0x10, 0x9f, 0x5e, 0x41, 0x92, 0x1e, 0xc2, 0x07, 0x52,
-	0x3c, 0x70, 0x7e, 0x41, 0x4e, 0xa5, 0x12, 0x83, 0x90, 0x1e, 0x17, 0x1b, 0xc4, 0x70, 0x21, 0x41,
-	0x90, 0x0c, 0x8a, 0xab, 0xa4, 0xf8, 0x91, 0x85, 0xc0, 0xea, 0x9d, 0xd8, 0xa2, 0x58, 0xf4, 0xac,
-	0x0b, 0x92, 0x92, 0xd8, 0xc0, 0x41, 0x64, 0x0c, 0x08, 0x00, 0x00, 0xff, 0xff, 0x4e, 0x5b, 0x0f,
-	0x0b, 0x32, 0x01, 0x00, 0x00,
+	// 329 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x92, 0x41, 0x6b, 0xea, 0x40,
+	0x10, 0xc7, 0xdd, 0x44, 0xf2, 0xde, 0x8e, 0xd1, 0xb7, 0x0e, 0x3c, 0x10, 0x4f, 0x36, 0x50, 0x08,
+	0x2d, 0x0d, 0xc5, 0x5e, 0x0a, 0x3d, 0xa5, 0xba, 0x05, 0xb1, 0x26, 0xb2, 0x69, 0xab, 0x78, 0x09,
+	0x89, 0xc9, 0x4d, 0x9b, 0x74, 0x4d, 0x04, 0x3f, 0x60, 0xbf, 0x57, 0x49, 0x52, 0x6d, 0xa5, 0x87,
+	0x96, 0xde, 0x76, 0xe6, 0xff, 0x9b, 0xfd, 0xb1, 0xc3, 0x82, 0x1e, 0x44, 0xd1, 0x66, 0xbb, 0xb4,
+	0x52, 0x99, 0x64, 0x09, 0x2a, 0x69, 0x68, 0x98, 0x00, 0x5e, 0xbe, 0x16, 0xf1, 0x4b, 0x1e, 0x6f,
+	0x32, 0xd4, 0x81, 0x04, 0x1d, 0xd2, 0x23, 0xa6, 0x2a, 0x48, 0x50, 0x54, 0x61, 0x47, 0xa9, 0xaa,
+	0xd0, 0x98, 0xc0, 0xdf, 0x92, 0x4c, 0x57, 0xbb, 0x22, 0xd9, 0xee, 0xb9, 0x2d, 0x32, 0x50, 0x63,
+	0x29, 0x4b, 0x92, 0x8a, 0xe2, 0x88, 0x27, 0x50, 0x5f, 0x26, 0x51, 0xdc, 0x51, 0x7b, 0xc4, 0x6c,
+	0xf5, 0x9b, 0x56, 0x1a, 0x5a, 0x5c, 0xca, 0x44, 0x0e, 0x92, 0x28, 0x16, 0x65, 0x64, 0x9c, 0x43,
+	0x73, 0x90, 0x3c, 0x2f, 0x83, 0xec, 0x8b, 0x9b, 0x1e, 0xb9, 0x69, 0xe1, 0x9e, 0x42, 0x63, 0x0f,
+	0x1f, 0xe9, 0xe9, 0x6f, 0xf5, 0x67, 0x73, 0xa0, 0x87, 0x16, 0x6a, 0xa0, 0xb8, 0x63, 0x56, 0xc3,
+	0x06, 0xfc, 0x79, 0x74, 0xc6, 0x8e, 0x3b, 0x73, 0x18, 0xc1, 0x26, 0xd0, 0x05, 0x17, 0xae, 0x3f,
+	0xb5, 0x85, 0xcd, 0x14, 0x64, 0xa0, 0x8f, 0x9c, 0x07, 0xdf, 0x7d, 0xe2, 0xe2, 0xee, 0xde, 0x9d,
+	0x31, 0x15, 0xff, 0x43, 0x7b, 0x62, 0xcf, 0x7d, 0x6f, 0xb4, 0xe0, 0x3e, 0x9f, 0x0f, 0x38, 0x1f,
+	0xf2, 0x21, 0xab, 0xf7, 0x5f, 0x09, 0xa8, 0x76, 0x14, 0xe1, 0x29, 0xa8, 0x5e, 0xbe, 0xc6, 0x56,
+	0x61, 0xff, 0x58, 0x71, 0x57, 0x3f, 0xd4, 0xe9, 0x6a, 0x67, 0xd4, 0xd0, 0x02, 0xad, 0x7a, 0x1a,
+	0xb6, 0x8b, 0xe4, 0x68, 0x27, 0xdd, 0x7f, 0x9f, 0x5b, 0x15, 0x7f, 0x01, 0xd4, 0xcb, 0xd7, 0x5e,
+	0x26, 0xe3, 0xe0, 0xdb, 0xcb, 0x4d, 0x82, 0xd7, 0xa0, 0x57, 0xf3, 0xef, 0x13, 0x3f, 0x92, 0x98,
+	0xe4, 0x92, 0xdc, 0x6a, 0x8b, 0xba, 0x75, 0x93, 0x86, 0xa1, 0x56, 0x7e, 0x96, 0xab, 0xb7, 0x01,
+	0x00, 0x26, 0x63, 0x1f, 0x5d, 0x3c, 0x02, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -252,6 +312,10 @@ const _ = grpc.SupportPackageIsVersion4
 type AddClient interface {
 	Sum(ctx context.Context, in *SumRequest, opts ...grpc.CallOption) (*SumReply, error)
 	Concat(ctx context.Context, in *ConcatRequest, opts ...grpc.CallOption) (*ConcatReply, error)
+	// SumStream 客户端以流的方式发送多个 SumRequest，服务端返回所有 a 和 b 的和
+	SumStream(ctx context.Context, opts ...grpc.CallOption) (Add_SumStreamClient, error)
+	// ConcatStream 每收到一个 ConcatRequest 就在同一个流上返回一个 ConcatReply，单条消息的错误不会中断流
+	ConcatStream(ctx context.Context, opts ...grpc.CallOption) (Add_ConcatStreamClient, error)
 }
 
 type addClient struct {
@@ -280,10 +344,79 @@ func (c *addClient) Concat(ctx context.Context, in *ConcatRequest, opts ...grpc.
 	return out, nil
 }
 
+func (c *addClient) SumStream(ctx context.Context, opts ...grpc.CallOption) (Add_SumStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Add_serviceDesc.Streams[0], "/pb.Add/SumStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &addSumStreamClient{stream}
+	return x, nil
+}
+
+type Add_SumStreamClient interface {
+	Send(*SumRequest) error
+	CloseAndRecv() (*SumReply, error)
+	grpc.ClientStream
+}
+
+type addSumStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *addSumStreamClient) Send(m *SumRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *addSumStreamClient) CloseAndRecv() (*SumReply, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(SumReply)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *addClient) ConcatStream(ctx context.Context, opts ...grpc.CallOption) (Add_ConcatStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Add_serviceDesc.Streams[1], "/pb.Add/ConcatStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &addConcatStreamClient{stream}
+	return x, nil
+}
+
+type Add_ConcatStreamClient interface {
+	Send(*ConcatRequest) error
+	Recv() (*ConcatReply, error)
+	grpc.ClientStream
+}
+
+type addConcatStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *addConcatStreamClient) Send(m *ConcatRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *addConcatStreamClient) Recv() (*ConcatReply, error) {
+	m := new(ConcatReply)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // AddServer is the server API for Add service.
 type AddServer interface {
 	Sum(context.Context, *SumRequest) (*SumReply, error)
 	Concat(context.Context, *ConcatRequest) (*ConcatReply, error)
+	// SumStream 客户端以流的方式发送多个 SumRequest，服务端返回所有 a 和 b 的和
+	SumStream(Add_SumStreamServer) error
+	// ConcatStream 每收到一个 ConcatRequest 就在同一个流上返回一个 ConcatReply，单条消息的错误不会中断流
+	ConcatStream(Add_ConcatStreamServer) error
 }
 
 // UnimplementedAddServer can be embedded to have forward compatible implementations.
@@ -296,6 +429,12 @@ func (*UnimplementedAddServer) Sum(ctx context.Context, req *SumRequest) (*SumRe
 func (*UnimplementedAddServer) Concat(ctx context.Context, req *ConcatRequest) (*ConcatReply, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Concat not implemented")
 }
+func (*UnimplementedAddServer) SumStream(srv Add_SumStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method SumStream not implemented")
+}
+func (*UnimplementedAddServer) ConcatStream(srv Add_ConcatStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method ConcatStream not implemented")
+}
 
 func RegisterAddServer(s *grpc.Server, srv AddServer) {
 	s.RegisterService(&_Add_serviceDesc, srv)
@@ -337,6 +476,58 @@ func _Add_Concat_Handler(srv interface{}, ctx context.Context, dec func(interfac
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Add_SumStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AddServer).SumStream(&addSumStreamServer{stream})
+}
+
+type Add_SumStreamServer interface {
+	SendAndClose(*SumReply) error
+	Recv() (*SumRequest, error)
+	grpc.ServerStream
+}
+
+type addSumStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *addSumStreamServer) SendAndClose(m *SumReply) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *addSumStreamServer) Recv() (*SumRequest, error) {
+	m := new(SumRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Add_ConcatStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AddServer).ConcatStream(&addConcatStreamServer{stream})
+}
+
+type Add_ConcatStreamServer interface {
+	Send(*ConcatReply) error
+	Recv() (*ConcatRequest, error)
+	grpc.ServerStream
+}
+
+type addConcatStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *addConcatStreamServer) Send(m *ConcatReply) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *addConcatStreamServer) Recv() (*ConcatRequest, error) {
+	m := new(ConcatRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 var _Add_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "pb.Add",
 	HandlerType: (*AddServer)(nil),
@@ -350,6 +541,18 @@ var _Add_serviceDesc = grpc.ServiceDesc{
 			Handler:    _Add_Concat_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SumStream",
+			Handler:       _Add_SumStream_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ConcatStream",
+			Handler:       _Add_ConcatStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
 	Metadata: "addsvc.proto",
 }
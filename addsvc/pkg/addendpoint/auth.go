@@ -0,0 +1,98 @@
+package addendpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	stdjwt "github.com/dgrijalva/jwt-go"
+	kitjwt "github.com/go-kit/kit/auth/jwt"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+//ErrUnauthenticated 所有认证失败的错误都可以用 errors.Is(err, ErrUnauthenticated) 判断，传输层据此返回 UNAUTHENTICATED
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+//JWTConfig JWT 认证的配置，Algorithm 是 HS 开头的算法时 KeyFile 是 HMAC 密钥，RS 开头时是 PEM 格式的 RSA 公钥
+//Audience 和 Issuer 为空时不检查
+type JWTConfig struct {
+	Algorithm string
+	KeyFile   string
+	Audience  string
+	Issuer    string
+}
+
+//NewJWTMiddleware 验证 context 中的 token(由传输层放入)，要求 token 必须有过期时间
+func NewJWTMiddleware(config JWTConfig) (endpoint.Middleware, error) {
+	method := stdjwt.GetSigningMethod(config.Algorithm)
+	if method == nil {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", config.Algorithm)
+	}
+	b, err := ioutil.ReadFile(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var key interface{}
+	switch {
+	case strings.HasPrefix(config.Algorithm, "HS"):
+		key = b
+	case strings.HasPrefix(config.Algorithm, "RS"), strings.HasPrefix(config.Algorithm, "PS"):
+		if key, err = stdjwt.ParseRSAPublicKeyFromPEM(b); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q, want HMAC or RSA", config.Algorithm)
+	}
+
+	parser := kitjwt.NewParser(func(*stdjwt.Token) (interface{}, error) {
+		return key, nil
+	}, method, kitjwt.StandardClaimsFactory)
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			// next 没有被调用说明认证失败，这时的错误都是认证错误
+			var authenticated bool
+			response, err := parser(func(ctx context.Context, request interface{}) (interface{}, error) {
+				if err := verifyClaims(ctx, config); err != nil {
+					return nil, err
+				}
+				authenticated = true
+				return next(ctx, request)
+			})(ctx, request)
+			if err != nil && !authenticated {
+				err = authError{err}
+			}
+			return response, err
+		}
+	}, nil
+}
+
+// verifyClaims kitjwt.NewParser 只检查了签名和时间，这里再检查过期时间是否存在、audience 和 issuer
+func verifyClaims(ctx context.Context, config JWTConfig) error {
+	claims, ok := ctx.Value(kitjwt.JWTClaimsContextKey).(*stdjwt.StandardClaims)
+	if !ok {
+		return kitjwt.ErrTokenInvalid
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return errors.New("token has no expiry")
+	}
+	if config.Audience != "" && !claims.VerifyAudience(config.Audience, true) {
+		return errors.New("token audience mismatch")
+	}
+	if config.Issuer != "" && !claims.VerifyIssuer(config.Issuer, true) {
+		return errors.New("token issuer mismatch")
+	}
+	return nil
+}
+
+// authError 保留原来的错误，同时可以被 errors.Is(err, ErrUnauthenticated) 识别
+type authError struct {
+	err error
+}
+
+func (e authError) Error() string        { return ErrUnauthenticated.Error() + ": " + e.err.Error() }
+func (e authError) Unwrap() error        { return e.err }
+func (e authError) Is(target error) bool { return target == ErrUnauthenticated }
@@ -0,0 +1,21 @@
+package addendpoint
+
+import (
+	"context"
+	"crypto/x509/pkix"
+)
+
+type contextKey int
+
+const clientSubjectKey contextKey = iota
+
+//WithClientSubject 由传输层调用，把已经验证过的客户端证书的 subject 放到 context 中
+func WithClientSubject(ctx context.Context, subject pkix.Name) context.Context {
+	return context.WithValue(ctx, clientSubjectKey, subject)
+}
+
+//ClientSubject 返回客户端证书的 subject，中间件可以据此做授权，没有使用 mTLS 时 ok 为 false
+func ClientSubject(ctx context.Context) (subject pkix.Name, ok bool) {
+	subject, ok = ctx.Value(clientSubjectKey).(pkix.Name)
+	return subject, ok
+}
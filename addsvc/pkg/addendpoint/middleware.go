@@ -2,11 +2,18 @@ package addendpoint
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"kitdemo/addsvc/pkg/addservice"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/ratelimit"
+	"github.com/sony/gobreaker"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 
 	"github.com/go-kit/kit/endpoint"
 )
@@ -15,7 +22,11 @@ func LoggingMiddleware(logger log.Logger) endpoint.Middleware {
 	return func(next endpoint.Endpoint) endpoint.Endpoint {
 		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 			defer func(begin time.Time) {
-				logger.Log("transport_error", err, "took", time.Since(begin))
+				keyvals := []interface{}{"transport_error", err, "took", time.Since(begin)}
+				if subject, ok := ClientSubject(ctx); ok {
+					keyvals = append(keyvals, "client", subject.String())
+				}
+				logger.Log(keyvals...)
 			}(time.Now())
 			return next(ctx, request)
 		}
@@ -32,3 +43,110 @@ func InstrumentingMiddleware(durations metrics.Histogram) endpoint.Middleware {
 		}
 	}
 }
+
+//TracingMiddleware 为每次 endpoint 调用创建一个 OpenTelemetry span，业务错误也会记录到 span 上
+func TracingMiddleware(tracer trace.Tracer, name string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			ctx, span := tracer.Start(ctx, name)
+			defer func() {
+				failed := err
+				if f, ok := response.(endpoint.Failer); ok && failed == nil {
+					failed = f.Failed()
+				}
+				if failed != nil {
+					span.RecordError(failed)
+					span.SetStatus(codes.Error, failed.Error())
+				}
+				span.End()
+			}()
+			return next(ctx, request)
+		}
+	}
+}
+
+//Limits 每个 endpoint 的频率限制和熔断配置
+type Limits struct {
+	RPS   float64 // 每秒允许的请求数(令牌桶的填充速度)，0 表示不限制
+	Burst int     // 令牌桶的容量，允许的突发请求数
+
+	BreakerFailures     uint32        // 连续失败多少次后熔断，0 使用 gobreaker 的默认值
+	BreakerTimeout      time.Duration // 熔断后多久进入半开状态，0 使用 gobreaker 的默认值
+	BreakerHalfOpenReqs uint32        // 半开状态下允许通过的请求数，0 使用 gobreaker 的默认值
+}
+
+//RateLimitMiddleware 令牌桶限流，超出限制的请求直接返回 ratelimit.ErrLimited
+func RateLimitMiddleware(limits Limits) endpoint.Middleware {
+	if limits.RPS <= 0 {
+		return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+	}
+	return ratelimit.NewErroringLimiter(rate.NewLimiter(rate.Limit(limits.RPS), limits.Burst))
+}
+
+//BreakerMiddleware gobreaker 熔断，endpoint 返回的错误和响应中业务规则之外的错误都算失败，见 isSuccessful
+//熔断器状态变化时记录日志，并将 state 设置为新的状态(0 关闭，1 半开，2 打开)
+func BreakerMiddleware(name string, limits Limits, state metrics.Gauge, logger log.Logger) endpoint.Middleware {
+	settings := gobreaker.Settings{
+		Name:        name,
+		MaxRequests: limits.BreakerHalfOpenReqs,
+		Timeout:     limits.BreakerTimeout,
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			logger.Log("breaker", name, "from", from, "to", to)
+			state.Set(float64(to))
+		},
+	}
+	if limits.BreakerFailures > 0 {
+		settings.ReadyToTrip = func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= limits.BreakerFailures
+		}
+	}
+	state.Set(float64(gobreaker.StateClosed))
+	cb := gobreaker.NewCircuitBreaker(settings)
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			called := false
+			// 业务错误放在响应中，endpoint 本身不返回错误，所以失败由 isSuccessful 判断后告诉 gobreaker
+			_, cbErr := cb.Execute(func() (interface{}, error) {
+				called = true
+				response, err = next(ctx, request)
+				if !isSuccessful(response, err) {
+					return nil, errFailed
+				}
+				return nil, nil
+			})
+			if !called {
+				return nil, cbErr // gobreaker.ErrOpenState 或 gobreaker.ErrTooManyRequests
+			}
+			return response, err
+		}
+	}
+}
+
+// errFailed 只用来告诉 gobreaker 这次调用失败了，不会返回给调用方
+var errFailed = errors.New("endpoint failed")
+
+// businessErrors 是业务规则拒绝请求时返回的错误，属于客户端的错误
+var businessErrors = []error{
+	addservice.ErrZeroPara,
+	addservice.ErrIntOverflow,
+	addservice.ErrMaxSizeExceeded,
+}
+
+// isSuccessful 熔断器只统计服务端的失败：endpoint 返回的错误和响应中的其他错误(包括 ctx 超时和取消)都算失败，
+// 业务规则拒绝的请求不算失败，否则客户端不停地发送非法参数就能让熔断器打开
+func isSuccessful(response interface{}, err error) bool {
+	if err == nil {
+		if f, ok := response.(endpoint.Failer); ok {
+			err = f.Failed()
+		}
+	}
+	if err == nil {
+		return true
+	}
+	for _, target := range businessErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -6,22 +6,37 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/tracing/zipkin"
+	stdzipkin "github.com/openzipkin/zipkin-go"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/go-kit/kit/endpoint"
 )
 
 type Set struct {
-	SumEndpoint    endpoint.Endpoint
-	ConcatEndpoint endpoint.Endpoint
+	SumEndpoint       endpoint.Endpoint
+	ConcatEndpoint    endpoint.Endpoint
+	SumStreamEndpoint endpoint.Endpoint
 }
 
-func New(svc addservice.Service, logger log.Logger, duration metrics.Histogram) Set {
+//New 返回一个安装了所有中间件的 Set，otelTracer 或 zipkinTracer 为 nil 时不开启对应的追踪
+//breakerState 记录每个 endpoint 熔断器的状态，使用 method 作为标签，auth 不为 nil 时每个请求都需要通过认证
+//追踪在限流和熔断之外，被拒绝的请求也会留下带有错误的 span
+func New(svc addservice.Service, logger log.Logger, duration metrics.Histogram, breakerState metrics.Gauge, limits Limits, auth endpoint.Middleware, otelTracer trace.Tracer, zipkinTracer *stdzipkin.Tracer) Set {
 	var sumEndpoint endpoint.Endpoint
 	{
 		sumEndpoint = MakeSumEndpoint(svc)
-		//TODO: zipkin trace
-		//TODO: open trace
-		//TODO: 频率限制和熔断
+		sumEndpoint = BreakerMiddleware("Sum", limits, breakerState.With("method", "Sum"), logger)(sumEndpoint)
+		sumEndpoint = RateLimitMiddleware(limits)(sumEndpoint)
+		if zipkinTracer != nil {
+			sumEndpoint = zipkin.TraceEndpoint(zipkinTracer, "Sum")(sumEndpoint)
+		}
+		if otelTracer != nil {
+			sumEndpoint = TracingMiddleware(otelTracer, "Sum")(sumEndpoint)
+		}
+		if auth != nil {
+			sumEndpoint = auth(sumEndpoint)
+		}
 		sumEndpoint = LoggingMiddleware(log.With(logger, "method", "Sum"))(sumEndpoint)
 		sumEndpoint = InstrumentingMiddleware(duration.With("method", "Sum"))(sumEndpoint)
 	}
@@ -29,16 +44,43 @@ func New(svc addservice.Service, logger log.Logger, duration metrics.Histogram)
 	var concatEndpoint endpoint.Endpoint
 	{
 		concatEndpoint = MakeConcatEndpoint(svc)
-		//TODO: zipkin trace
-		//TODO: open trace
-		//TODO: 频率限制和熔断
+		concatEndpoint = BreakerMiddleware("Concat", limits, breakerState.With("method", "Concat"), logger)(concatEndpoint)
+		concatEndpoint = RateLimitMiddleware(limits)(concatEndpoint)
+		if zipkinTracer != nil {
+			concatEndpoint = zipkin.TraceEndpoint(zipkinTracer, "Concat")(concatEndpoint)
+		}
+		if otelTracer != nil {
+			concatEndpoint = TracingMiddleware(otelTracer, "Concat")(concatEndpoint)
+		}
+		if auth != nil {
+			concatEndpoint = auth(concatEndpoint)
+		}
 		concatEndpoint = LoggingMiddleware(log.With(logger, "method", "Concat"))(concatEndpoint)
 		concatEndpoint = InstrumentingMiddleware(duration.With("method", "Concat"))(concatEndpoint)
 	}
 
+	var sumStreamEndpoint endpoint.Endpoint
+	{
+		sumStreamEndpoint = MakeSumStreamEndpoint(svc)
+		sumStreamEndpoint = BreakerMiddleware("SumStream", limits, breakerState.With("method", "SumStream"), logger)(sumStreamEndpoint)
+		sumStreamEndpoint = RateLimitMiddleware(limits)(sumStreamEndpoint)
+		if zipkinTracer != nil {
+			sumStreamEndpoint = zipkin.TraceEndpoint(zipkinTracer, "SumStream")(sumStreamEndpoint)
+		}
+		if otelTracer != nil {
+			sumStreamEndpoint = TracingMiddleware(otelTracer, "SumStream")(sumStreamEndpoint)
+		}
+		if auth != nil {
+			sumStreamEndpoint = auth(sumStreamEndpoint)
+		}
+		sumStreamEndpoint = LoggingMiddleware(log.With(logger, "method", "SumStream"))(sumStreamEndpoint)
+		sumStreamEndpoint = InstrumentingMiddleware(duration.With("method", "SumStream"))(sumStreamEndpoint)
+	}
+
 	return Set{
-		SumEndpoint:    sumEndpoint,
-		ConcatEndpoint: concatEndpoint,
+		SumEndpoint:       sumEndpoint,
+		ConcatEndpoint:    concatEndpoint,
+		SumStreamEndpoint: sumStreamEndpoint,
 	}
 }
 
@@ -62,6 +104,18 @@ func (s Set) Concat(ctx context.Context, a, b string) (string, error) {
 	return response.V, response.Err
 }
 
+//SumStream Set 实现 Service 接口，返回后在后台读完 numbers 中剩下的数字，直到调用方关闭它
+//被限流、熔断、没有可用实例或者溢出时 endpoint 会提前返回，这样调用方不会阻塞在写 numbers 上
+func (s Set) SumStream(ctx context.Context, numbers <-chan int) (int, error) {
+	defer func() { go drain(numbers) }()
+	resp, err := s.SumStreamEndpoint(ctx, SumStreamRequest{Numbers: numbers})
+	if err != nil {
+		return 0, err
+	}
+	response := resp.(SumResponse)
+	return response.V, response.Err
+}
+
 func MakeSumEndpoint(s addservice.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(SumRequest)
@@ -78,6 +132,15 @@ func MakeConcatEndpoint(s addservice.Service) endpoint.Endpoint {
 	}
 }
 
+//MakeSumStreamEndpoint 整个流对应一次 endpoint 调用，所以限流、熔断等中间件作用在整个流上
+func MakeSumStreamEndpoint(s addservice.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(SumStreamRequest)
+		v, err := s.SumStream(ctx, req.Numbers)
+		return SumResponse{V: v, Err: err}, nil
+	}
+}
+
 // 类型断言，保证 SumResponse 和 ConcatResponse 都实现了 Failer 接口
 var (
 	_ endpoint.Failer = SumResponse{}
@@ -96,6 +159,18 @@ type SumResponse struct {
 //Failed 实现了 endpoint.Failer 接口
 func (r SumResponse) Failed() error { return r.Err }
 
+//SumStreamRequest SumStream 的请求参数，传输层把从流中收到的数字写入 Numbers，流结束时关闭它
+//endpoint 可以不读完 Numbers 就返回，剩下的数字由调用方负责读完(Set.SumStream)或者通过取消 ctx 停止写入(gRPC 服务端)
+type SumStreamRequest struct {
+	Numbers <-chan int
+}
+
+// drain 读完 numbers 中剩下的数字
+func drain(numbers <-chan int) {
+	for range numbers {
+	}
+}
+
 //ConcatRequest Concat RPC 接口的请求参数
 type ConcatRequest struct {
 	A, B string
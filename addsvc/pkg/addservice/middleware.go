@@ -5,6 +5,9 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Middleware func(Service) Service
@@ -25,6 +28,13 @@ func InstrumentingMiddleware(ints, chars metrics.Counter) Middleware {
 	}
 }
 
+//TracingMiddleware 为每次业务方法的调用创建一个 OpenTelemetry span，并记录参数
+func TracingMiddleware(tracer trace.Tracer) Middleware {
+	return func(next Service) Service {
+		return tracingMiddleware{tracer, next}
+	}
+}
+
 type loggingMiddleware struct {
 	logger log.Logger
 	next   Service
@@ -42,6 +52,12 @@ func (mw loggingMiddleware) Concat(ctx context.Context, a, b string) (v string,
 	}()
 	return mw.next.Concat(ctx, a, b)
 }
+func (mw loggingMiddleware) SumStream(ctx context.Context, numbers <-chan int) (v int, err error) {
+	defer func() {
+		mw.logger.Log("method", "SumStream", "v", v, "err", err)
+	}()
+	return mw.next.SumStream(ctx, numbers)
+}
 
 type instrumentingMiddleware struct {
 	ints  metrics.Counter
@@ -59,3 +75,43 @@ func (mw instrumentingMiddleware) Concat(ctx context.Context, a, b string) (v st
 	mw.ints.Add(float64(len(v)))
 	return mw.next.Concat(ctx, a, b)
 }
+func (mw instrumentingMiddleware) SumStream(ctx context.Context, numbers <-chan int) (v int, err error) {
+	v, err = mw.next.SumStream(ctx, numbers)
+	mw.ints.Add(float64(v))
+	return v, err
+}
+
+type tracingMiddleware struct {
+	tracer trace.Tracer
+	next   Service
+}
+
+func (mw tracingMiddleware) Sum(ctx context.Context, a, b int) (v int, err error) {
+	ctx, span := mw.tracer.Start(ctx, "addservice.Sum", trace.WithAttributes(
+		attribute.Int("a", a),
+		attribute.Int("b", b),
+	))
+	defer func() { endSpan(span, err) }()
+	return mw.next.Sum(ctx, a, b)
+}
+func (mw tracingMiddleware) Concat(ctx context.Context, a, b string) (v string, err error) {
+	ctx, span := mw.tracer.Start(ctx, "addservice.Concat", trace.WithAttributes(
+		attribute.String("a", a),
+		attribute.String("b", b),
+	))
+	defer func() { endSpan(span, err) }()
+	return mw.next.Concat(ctx, a, b)
+}
+func (mw tracingMiddleware) SumStream(ctx context.Context, numbers <-chan int) (v int, err error) {
+	ctx, span := mw.tracer.Start(ctx, "addservice.SumStream")
+	defer func() { endSpan(span, err) }()
+	return mw.next.SumStream(ctx, numbers)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -3,24 +3,32 @@ package addservice
 import (
 	"context"
 	"errors"
+	"sync/atomic"
 
 	"github.com/go-kit/kit/log"
 
 	"github.com/go-kit/kit/metrics"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Service interface {
 	Sum(ctx context.Context, a, b int) (int, error)
 	Concat(ctx context.Context, a, b string) (string, error)
+	// SumStream 对 numbers 中的所有数字求和，直到 numbers 被关闭，numbers 由调用方负责关闭
+	SumStream(ctx context.Context, numbers <-chan int) (int, error)
 }
 
-//New 返回一个基础的 addsvc.Service 服务，安装了统计和日志的中间件
-func New(logger log.Logger, ints, chars metrics.Counter) Service {
+//New 返回一个基础的 addsvc.Service 服务，安装了统计和日志的中间件，tracer 不为 nil 时还会安装追踪的中间件
+//业务规则每次调用时从 limits 中读取，替换 limits 中的值后立即生效
+func New(logger log.Logger, ints, chars metrics.Counter, tracer trace.Tracer, limits *LimitsStore) Service {
 	var svc Service
 	{
-		svc = NewBasicService()
+		svc = NewBasicService(limits)
 		svc = LoggingMiddleware(logger)(svc)
 		svc = InstrumentingMiddleware(ints, chars)(svc)
+		if tracer != nil {
+			svc = TracingMiddleware(tracer)(svc)
+		}
 	}
 	return svc
 }
@@ -36,22 +44,82 @@ var (
 	ErrMaxSizeExceeded = errors.New("result exceeds maximum size")
 )
 
-const (
-	intMax = 1<<31 - 1
-	intMin = -(intMax + 1)
-	maxLen = 10
-)
+//Limits 业务规则
+type Limits struct {
+	MaxLen     int  // Concat 结果的最大长度
+	IntMax     int  // Sum 结果的最大值，最小值是 -IntMax-1
+	RejectZero bool // Sum 的参数是否不能为0
+}
+
+//DefaultLimits 默认的业务规则
+func DefaultLimits() Limits {
+	return Limits{
+		MaxLen:     10,
+		IntMax:     1<<31 - 1,
+		RejectZero: true,
+	}
+}
 
-type basicService struct{}
+//LimitsStore 保存当前生效的业务规则，可以在服务运行时安全地替换
+type LimitsStore struct {
+	v atomic.Value
+}
+
+func NewLimitsStore(limits Limits) *LimitsStore {
+	s := &LimitsStore{}
+	s.Store(limits)
+	return s
+}
+
+func (s *LimitsStore) Load() Limits {
+	return s.v.Load().(Limits)
+}
 
-func NewBasicService() Service {
-	return basicService{}
+func (s *LimitsStore) Store(limits Limits) {
+	s.v.Store(limits)
+}
+
+type basicService struct {
+	limits *LimitsStore
+}
+
+func NewBasicService(limits *LimitsStore) Service {
+	return basicService{limits: limits}
 }
 
 func (s basicService) Sum(_ context.Context, a, b int) (int, error) {
-	if a == 0 || b == 0 {
+	limits := s.limits.Load()
+	if limits.RejectZero && (a == 0 || b == 0) {
 		return 0, ErrZeroPara
 	}
+	return add(a, b, limits.IntMax)
+}
+
+//SumStream 每加一个数都会检查是否溢出，溢出后不再读取剩下的数字
+//和 Sum 不同，流中的数字可以是0，整个流使用开始时的业务规则
+func (s basicService) SumStream(ctx context.Context, numbers <-chan int) (int, error) {
+	var (
+		v   int
+		err error
+	)
+	intMax := s.limits.Load().IntMax
+	for {
+		select {
+		case n, ok := <-numbers:
+			if !ok {
+				return v, nil
+			}
+			if v, err = add(v, n, intMax); err != nil {
+				return 0, err
+			}
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func add(a, b, intMax int) (int, error) {
+	intMin := -intMax - 1
 	if (b > 0 && a > (intMax-b)) || (b < 0 && a < (intMin-b)) {
 		return 0, ErrIntOverflow
 	}
@@ -59,7 +127,7 @@ func (s basicService) Sum(_ context.Context, a, b int) (int, error) {
 }
 
 func (s basicService) Concat(_ context.Context, a, b string) (string, error) {
-	if len(a)+len(b) > maxLen {
+	if len(a)+len(b) > s.limits.Load().MaxLen {
 		return "", ErrMaxSizeExceeded
 	}
 	return a + b, nil
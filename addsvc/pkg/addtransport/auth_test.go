@@ -0,0 +1,149 @@
+package addtransport
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"kitdemo/addsvc/pkg/addendpoint"
+	"kitdemo/addsvc/pkg/addservice"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	stdjwt "github.com/dgrijalva/jwt-go"
+	kitjwt "github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// startAuthServers 用 config 开启 JWT 认证，同时提供 gRPC 和 HTTP 服务
+func startAuthServers(t *testing.T, config addendpoint.JWTConfig) (addservice.Service, string) {
+	t.Helper()
+	auth, err := addendpoint.NewJWTMiddleware(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := addservice.New(log.NewNopLogger(), discard.NewCounter(), discard.NewCounter(), nil, addservice.NewLimitsStore(addservice.DefaultLimits()))
+	endpoints := addendpoint.New(svc, log.NewNopLogger(), discard.NewHistogram(), discard.NewGauge(), addendpoint.Limits{}, auth, nil, nil)
+
+	server := httptest.NewServer(NewHTTPHandler(endpoints, log.NewNopLogger()))
+	t.Cleanup(server.Close)
+	return NewGRPCClient(serveGRPC(t, endpoints, nil, nil), nil, nil, nil, log.NewNopLogger()), server.URL
+}
+
+func writeFile(t *testing.T, name string, b []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func sign(t *testing.T, method stdjwt.SigningMethod, claims stdjwt.Claims, key interface{}) string {
+	t.Helper()
+	token, err := stdjwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWTMiddleware(t *testing.T) {
+	secret := []byte("secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	hsClient, hsURL := startAuthServers(t, addendpoint.JWTConfig{
+		Algorithm: "HS256",
+		KeyFile:   writeFile(t, "secret", secret),
+		Audience:  "addsvc",
+		Issuer:    "issuer",
+	})
+	rsClient, rsURL := startAuthServers(t, addendpoint.JWTConfig{
+		Algorithm: "RS256",
+		KeyFile:   writeFile(t, "public.pem", publicPEM),
+	})
+
+	valid := func() *stdjwt.StandardClaims {
+		return &stdjwt.StandardClaims{
+			Audience:  "addsvc",
+			Issuer:    "issuer",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	with := func(f func(*stdjwt.StandardClaims)) *stdjwt.StandardClaims {
+		c := valid()
+		f(c)
+		return c
+	}
+
+	for _, tc := range []struct {
+		name   string
+		client addservice.Service
+		url    string
+		token  string
+		ok     bool
+	}{
+		{"valid HS256", hsClient, hsURL, sign(t, stdjwt.SigningMethodHS256, valid(), secret), true},
+		{"valid RS256", rsClient, rsURL, sign(t, stdjwt.SigningMethodRS256, valid(), rsaKey), true},
+		{"missing token", hsClient, hsURL, "", false},
+		{"bad signature", hsClient, hsURL, sign(t, stdjwt.SigningMethodHS256, valid(), []byte("other")), false},
+		{"alg none", hsClient, hsURL, sign(t, stdjwt.SigningMethodNone, valid(), stdjwt.UnsafeAllowNoneSignatureType), false},
+		{"HS256 instead of RS256", rsClient, rsURL, sign(t, stdjwt.SigningMethodHS256, valid(), publicPEM), false},
+		{"HS512 instead of HS256", hsClient, hsURL, sign(t, stdjwt.SigningMethodHS512, valid(), secret), false},
+		{"expired", hsClient, hsURL, sign(t, stdjwt.SigningMethodHS256, with(func(c *stdjwt.StandardClaims) { c.ExpiresAt = time.Now().Add(-time.Minute).Unix() }), secret), false},
+		{"missing exp", hsClient, hsURL, sign(t, stdjwt.SigningMethodHS256, with(func(c *stdjwt.StandardClaims) { c.ExpiresAt = 0 }), secret), false},
+		{"audience mismatch", hsClient, hsURL, sign(t, stdjwt.SigningMethodHS256, with(func(c *stdjwt.StandardClaims) { c.Audience = "other" }), secret), false},
+		{"issuer mismatch", hsClient, hsURL, sign(t, stdjwt.SigningMethodHS256, with(func(c *stdjwt.StandardClaims) { c.Issuer = "other" }), secret), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.token != "" {
+				ctx = context.WithValue(ctx, kitjwt.JWTTokenContextKey, tc.token)
+			}
+			_, err := tc.client.Sum(ctx, 1, 2)
+			if want, have := codes.OK, status.Code(err); tc.ok && want != have {
+				t.Errorf("gRPC: want %s, have %v", want, err)
+			}
+			if want, have := codes.Unauthenticated, status.Code(err); !tc.ok && want != have {
+				t.Errorf("gRPC: want %s, have %v", want, err)
+			}
+
+			req, err := http.NewRequest("POST", tc.url+"/sum", strings.NewReader(`{"a":1,"b":2}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			want := http.StatusUnauthorized
+			if tc.ok {
+				want = http.StatusOK
+			}
+			if resp.StatusCode != want {
+				t.Errorf("HTTP: want %d, have %d", want, resp.StatusCode)
+			}
+		})
+	}
+}
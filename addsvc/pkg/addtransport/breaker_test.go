@@ -0,0 +1,88 @@
+package addtransport
+
+import (
+	"context"
+	"errors"
+	"kitdemo/addsvc/pkg/addendpoint"
+	"kitdemo/addsvc/pkg/addservice"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flakyService down 不为 0 时 Sum 返回不属于业务规则的错误，其他时候和正常的服务一样
+type flakyService struct {
+	addservice.Service
+	down int32
+}
+
+func (s *flakyService) Sum(ctx context.Context, a, b int) (int, error) {
+	if atomic.LoadInt32(&s.down) != 0 {
+		return 0, errors.New("backend unavailable")
+	}
+	return s.Service.Sum(ctx, a, b)
+}
+
+func newFlakyEndpoints() (*flakyService, addendpoint.Set) {
+	svc := &flakyService{Service: addservice.NewBasicService(addservice.NewLimitsStore(addservice.DefaultLimits()))}
+	return svc, newEndpoints(svc, addendpoint.Limits{BreakerFailures: 2, BreakerTimeout: time.Hour}, nil, nil)
+}
+
+func TestBreakerTripsOverGRPC(t *testing.T) {
+	svc, endpoints := newFlakyEndpoints()
+	client := NewGRPCClient(serveGRPC(t, endpoints, nil, nil), nil, nil, nil, log.NewNopLogger())
+	ctx := context.Background()
+
+	// 业务规则拒绝的请求不算失败
+	for i := 0; i < 5; i++ {
+		if _, err := client.Sum(ctx, 0, 1); !errors.Is(err, addservice.ErrZeroPara) {
+			t.Fatalf("Sum(0, 1): want ErrZeroPara, have %v", err)
+		}
+	}
+	if _, err := client.Sum(ctx, 1, 2); err != nil {
+		t.Fatalf("breaker tripped on business errors: %v", err)
+	}
+
+	atomic.StoreInt32(&svc.down, 1)
+	for i := 0; i < 2; i++ {
+		if _, err := client.Sum(ctx, 1, 2); err == nil || status.Code(err) == codes.Unavailable {
+			t.Fatalf("call %d: want a backend error, have %v", i, err)
+		}
+	}
+	atomic.StoreInt32(&svc.down, 0)
+	if _, err := client.Sum(ctx, 1, 2); status.Code(err) != codes.Unavailable {
+		t.Errorf("want Unavailable once the breaker is open, have %v", err)
+	}
+}
+
+func TestBreakerTripsOverHTTP(t *testing.T) {
+	svc, endpoints := newFlakyEndpoints()
+	server := httptest.NewServer(NewHTTPHandler(endpoints, log.NewNopLogger()))
+	defer server.Close()
+	sum := func() int {
+		resp, err := http.Post(server.URL+"/sum", "application/json", strings.NewReader(`{"a":1,"b":2}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	atomic.StoreInt32(&svc.down, 1)
+	for i := 0; i < 2; i++ {
+		if want, have := http.StatusInternalServerError, sum(); want != have {
+			t.Fatalf("call %d: want %d, have %d", i, want, have)
+		}
+	}
+	atomic.StoreInt32(&svc.down, 0)
+	if want, have := http.StatusServiceUnavailable, sum(); want != have {
+		t.Errorf("want %d once the breaker is open, have %d", want, have)
+	}
+}
@@ -0,0 +1,80 @@
+package addtransport
+
+import (
+	"context"
+	"errors"
+	"kitdemo/addsvc/pkg/addendpoint"
+	"kitdemo/addsvc/pkg/addservice"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// testEndpoints 使用默认业务规则的 addsvc
+func testEndpoints() addendpoint.Set {
+	svc := addservice.New(log.NewNopLogger(), discard.NewCounter(), discard.NewCounter(), nil, addservice.NewLimitsStore(addservice.DefaultLimits()))
+	return newEndpoints(svc, addendpoint.Limits{}, nil, nil)
+}
+
+// startNATSClient 启动一个进程内的 NATS 服务，在上面订阅 endpoints，返回连接到它的客户端
+func startNATSClient(t *testing.T, endpoints addendpoint.Set) addservice.Service {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(2 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	if _, err := NewNATSServer(endpoints, log.NewNopLogger()).Subscribe(nc, "addsvc"); err != nil {
+		t.Fatal(err)
+	}
+	return NewNATSClient(nc, log.NewNopLogger())
+}
+
+func TestBusinessErrorsRoundTrip(t *testing.T) {
+	endpoints := testEndpoints()
+
+	server := httptest.NewServer(NewHTTPHandler(endpoints, log.NewNopLogger()))
+	defer server.Close()
+	httpClient, err := NewHTTPClient(server.URL, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := map[string]addservice.Service{
+		"gRPC": NewGRPCClient(serveGRPC(t, endpoints, nil, nil), nil, nil, nil, log.NewNopLogger()),
+		"HTTP": httpClient,
+		"NATS": startNATSClient(t, endpoints),
+	}
+	intMax := addservice.DefaultLimits().IntMax
+	for name, client := range clients {
+		ctx := context.Background()
+		if _, err := client.Sum(ctx, 0, 1); !errors.Is(err, addservice.ErrZeroPara) {
+			t.Errorf("%s Sum(0, 1): want ErrZeroPara, have %v", name, err)
+		}
+		if _, err := client.Sum(ctx, intMax, 1); !errors.Is(err, addservice.ErrIntOverflow) {
+			t.Errorf("%s Sum(IntMax, 1): want ErrIntOverflow, have %v", name, err)
+		}
+		if _, err := client.Concat(ctx, strings.Repeat("a", 10), "b"); !errors.Is(err, addservice.ErrMaxSizeExceeded) {
+			t.Errorf("%s Concat: want ErrMaxSizeExceeded, have %v", name, err)
+		}
+		if v, err := client.Sum(ctx, 1, 2); err != nil || v != 3 {
+			t.Errorf("%s Sum(1, 2): want 3, have %d, %v", name, v, err)
+		}
+	}
+}
@@ -2,14 +2,22 @@ package addtransport
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"kitdemo/addsvc/pb"
 	"kitdemo/addsvc/pkg/addservice"
 
+	kitjwt "github.com/go-kit/kit/auth/jwt"
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/ratelimit"
+	"github.com/go-kit/kit/tracing/zipkin"
 	"github.com/go-kit/kit/transport"
+	stdzipkin "github.com/openzipkin/zipkin-go"
+	"github.com/sony/gobreaker"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"kitdemo/addsvc/pkg/addendpoint"
 
@@ -17,13 +25,27 @@ import (
 )
 
 type grpcServer struct {
-	sum    grpctransport.Handler
-	concat grpctransport.Handler
+	sum          grpctransport.Handler
+	concat       grpctransport.Handler
+	sumStream    endpoint.Endpoint
+	concatStream streamServer
+
+	otelTracer trace.Tracer
 }
 
-func NewGRPCServer(endpoints addendpoint.Set, logger log.Logger) pb.AddServer {
+//NewGRPCServer otelTracer 和 zipkinTracer 不为 nil 时会从 gRPC metadata 中取出调用方的 trace 信息
+//使用 mTLS 时客户端证书的 subject 可以通过 addendpoint.ClientSubject 取得，authorization metadata 中的 JWT 放到 context 中
+func NewGRPCServer(endpoints addendpoint.Set, otelTracer trace.Tracer, zipkinTracer *stdzipkin.Tracer, logger log.Logger) pb.AddServer {
 	options := []grpctransport.ServerOption{
 		grpctransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
+		grpcClientSubject(),
+		grpctransport.ServerBefore(kitjwt.GRPCToContext()),
+	}
+	if otelTracer != nil {
+		options = append(options, otelGRPCServerTrace(otelTracer))
+	}
+	if zipkinTracer != nil {
+		options = append(options, zipkin.GRPCServerTrace(zipkinTracer))
 	}
 	return &grpcServer{
 		sum: grpctransport.NewServer(
@@ -38,11 +60,35 @@ func NewGRPCServer(endpoints addendpoint.Set, logger log.Logger) pb.AddServer {
 			encodeGRPCConcatResponse,
 			options...,
 		),
+		sumStream: endpoints.SumStreamEndpoint,
+		concatStream: newStreamServer(
+			endpoints.ConcatEndpoint,
+			decodeGRPCConcatRequest,
+			encodeGRPCConcatResponse,
+			encodeGRPCConcatStreamError,
+			transport.NewLogErrorHandler(logger),
+		),
+		otelTracer: otelTracer,
 	}
 }
 
-func NewGRPCClient(conn *grpc.ClientConn, logger log.Logger) addservice.Service {
-	var options []grpctransport.ClientOption
+//NewGRPCClient otelTracer 和 zipkinTracer 不为 nil 时会将 trace 信息放到 gRPC metadata 中传给服务端
+//context 中有 JWT(kitjwt.JWTTokenContextKey)时放到 authorization metadata 中，clientMetrics 不为 nil 时记录每一次调用
+func NewGRPCClient(conn *grpc.ClientConn, otelTracer trace.Tracer, zipkinTracer *stdzipkin.Tracer, clientMetrics *ClientMetrics, logger log.Logger) addservice.Service {
+	return newGRPCClientSet(conn, otelTracer, zipkinTracer, clientMetrics, logger)
+}
+
+// newGRPCClientSet 返回的 endpoint 中，业务错误放在响应里，只有传输层的错误才会作为 error 返回
+func newGRPCClientSet(conn *grpc.ClientConn, otelTracer trace.Tracer, zipkinTracer *stdzipkin.Tracer, clientMetrics *ClientMetrics, logger log.Logger) addendpoint.Set {
+	options := []grpctransport.ClientOption{
+		grpctransport.ClientBefore(kitjwt.ContextToGRPC()),
+	}
+	if otelTracer != nil {
+		options = append(options, otelGRPCClientTrace(otelTracer))
+	}
+	if zipkinTracer != nil {
+		options = append(options, zipkin.GRPCClientTrace(zipkinTracer))
+	}
 
 	var sumEndpoint endpoint.Endpoint
 	{
@@ -55,6 +101,7 @@ func NewGRPCClient(conn *grpc.ClientConn, logger log.Logger) addservice.Service
 			pb.SumReply{},
 			options...,
 		).Endpoint()
+		sumEndpoint = clientMetrics.instrument("Sum")(sumEndpoint)
 	}
 
 	var concatEndpoint endpoint.Endpoint
@@ -68,18 +115,20 @@ func NewGRPCClient(conn *grpc.ClientConn, logger log.Logger) addservice.Service
 			pb.ConcatReply{},
 			options...,
 		).Endpoint()
+		concatEndpoint = clientMetrics.instrument("Concat")(concatEndpoint)
 	}
 
 	return addendpoint.Set{
-		SumEndpoint:    sumEndpoint,
-		ConcatEndpoint: concatEndpoint,
+		SumEndpoint:       sumEndpoint,
+		ConcatEndpoint:    concatEndpoint,
+		SumStreamEndpoint: clientMetrics.instrument("SumStream")(makeGRPCSumStreamClient(conn, otelTracer)),
 	}
 }
 
 func (s *grpcServer) Sum(ctx context.Context, req *pb.SumRequest) (*pb.SumReply, error) {
 	_, rep, err := s.sum.ServeGRPC(ctx, req)
 	if err != nil {
-		return nil, err
+		return nil, err2status(err)
 	}
 	// 这里是将 rep 转换成了指针类型
 	return rep.(*pb.SumReply), nil
@@ -87,7 +136,7 @@ func (s *grpcServer) Sum(ctx context.Context, req *pb.SumRequest) (*pb.SumReply,
 func (s *grpcServer) Concat(ctx context.Context, req *pb.ConcatRequest) (*pb.ConcatReply, error) {
 	_, rep, err := s.concat.ServeGRPC(ctx, req)
 	if err != nil {
-		return nil, err
+		return nil, err2status(err)
 	}
 	// 这里是将 rep 转换成了指针类型
 	return rep.(*pb.ConcatReply), nil
@@ -110,17 +159,19 @@ func encodeGRPCSumRequest(_ context.Context, request interface{}) (interface{},
 
 func decodeGRPCSumResponse(_ context.Context, grpcResp interface{}) (interface{}, error) {
 	resp := grpcResp.(*pb.SumReply)
-	return addendpoint.SumResponse{V: int(resp.V), Err: str2err(resp.Err)}, nil
+	return addendpoint.SumResponse{V: int(resp.V), Err: decodeError(resp.Err, resp.Code)}, nil
 }
 
 func encodeGRPCSumResponse(_ context.Context, response interface{}) (interface{}, error) {
 	resp := response.(addendpoint.SumResponse)
-	return &pb.SumReply{V: int64(resp.V), Err: err2str(resp.Err)}, nil
+	msg, code := encodeError(resp.Err)
+	return &pb.SumReply{V: int64(resp.V), Err: msg, Code: code}, nil
 }
 
 func encodeGRPCConcatResponse(_ context.Context, grpcResp interface{}) (interface{}, error) {
 	resp := grpcResp.(addendpoint.ConcatResponse)
-	return &pb.ConcatReply{V: resp.V, Err: err2str(resp.Err)}, nil
+	msg, code := encodeError(resp.Err)
+	return &pb.ConcatReply{V: resp.V, Err: msg, Code: code}, nil
 }
 
 func encodeGRPCConcatRequest(_ context.Context, request interface{}) (interface{}, error) {
@@ -130,19 +181,52 @@ func encodeGRPCConcatRequest(_ context.Context, request interface{}) (interface{
 
 func decodeGRPCConcatResponse(_ context.Context, response interface{}) (interface{}, error) {
 	resp := response.(*pb.ConcatReply)
-	return addendpoint.ConcatResponse{V: resp.V, Err: str2err(resp.Err)}, nil
+	return addendpoint.ConcatResponse{V: resp.V, Err: decodeError(resp.Err, resp.Code)}, nil
+}
+
+//err2status 认证失败、被限流和熔断拒绝的请求使用对应的 gRPC 状态码返回，客户端可以据此决定是否重试
+func err2status(err error) error {
+	switch {
+	case errors.Is(err, addendpoint.ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, ratelimit.ErrLimited):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, gobreaker.ErrOpenState), errors.Is(err, gobreaker.ErrTooManyRequests):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return err
 }
 
-func err2str(err error) string {
+// errorCodes 是业务错误和错误码之间的对应关系，错误码在网络上传输，客户端据此还原出原来的错误
+var errorCodes = map[error]pb.ErrorCode{
+	addservice.ErrZeroPara:        pb.ErrorCode_ZERO_PARA,
+	addservice.ErrIntOverflow:     pb.ErrorCode_INT_OVERFLOW,
+	addservice.ErrMaxSizeExceeded: pb.ErrorCode_MAX_SIZE_EXCEEDED,
+}
+
+//encodeError 将错误转换成错误信息和错误码，不认识的错误使用 UNKNOWN
+func encodeError(err error) (string, pb.ErrorCode) {
 	if err == nil {
-		return ""
+		return "", pb.ErrorCode_OK
 	}
-	return err.Error()
+	for target, code := range errorCodes {
+		if errors.Is(err, target) {
+			return err.Error(), code
+		}
+	}
+	return err.Error(), pb.ErrorCode_UNKNOWN
 }
 
-func str2err(str string) error {
-	if str == "" {
+//decodeError 根据错误码还原出 addservice 中的错误，这样客户端可以使用 errors.Is 判断
+//不认识的错误码(比如老版本的服务端)只保留错误信息
+func decodeError(msg string, code pb.ErrorCode) error {
+	for target, c := range errorCodes {
+		if c == code {
+			return target
+		}
+	}
+	if msg == "" {
 		return nil
 	}
-	return fmt.Errorf("%s", str)
+	return errors.New(msg)
 }
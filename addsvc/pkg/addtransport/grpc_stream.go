@@ -0,0 +1,277 @@
+package addtransport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"kitdemo/addsvc/pb"
+	"kitdemo/addsvc/pkg/addendpoint"
+
+	kitjwt "github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/transport"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+)
+
+// grpctransport 只支持一元 RPC，流式 RPC 在这里自己完成流和 endpoint 之间的转换
+// 流式 RPC 只支持 OpenTelemetry 追踪
+
+//ErrStreamingUnsupported HTTP 和 NATS 客户端调用流式方法时返回这个错误
+var ErrStreamingUnsupported = errors.New("streaming methods are only supported over gRPC")
+
+func unsupportedStreamEndpoint(context.Context, interface{}) (interface{}, error) {
+	return nil, ErrStreamingUnsupported
+}
+
+//SumStream 流中每个 SumRequest 的 a 和 b 都会被加到总和中，业务错误和 Sum 一样放在 SumReply 中返回
+func (s *grpcServer) SumStream(stream pb.Add_SumStreamServer) (err error) {
+	ctx, cancel := context.WithCancel(streamContext(stream.Context()))
+	defer cancel()
+	if s.otelTracer != nil {
+		var span trace.Span
+		ctx, span = otelStartServerSpan(ctx, s.otelTracer, "/pb.Add/SumStream")
+		defer func() { endOTelSpan(span, err) }()
+	}
+
+	numbers, recvErr := recvSumStream(ctx, cancel, stream)
+	resp, err := s.sumStream(ctx, addendpoint.SumStreamRequest{Numbers: numbers})
+	if err != nil {
+		return err2status(err)
+	}
+	select {
+	case err := <-recvErr:
+		return err
+	default:
+	}
+	reply, err := encodeGRPCSumResponse(ctx, resp)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(reply.(*pb.SumReply))
+}
+
+//recvSumStream 在单独的 goroutine 中读取流，客户端发送完毕后关闭 numbers
+//读取出错时先把错误放到 errc 中再取消 ctx，这样不会把不完整的和当作结果返回
+func recvSumStream(ctx context.Context, cancel context.CancelFunc, stream pb.Add_SumStreamServer) (<-chan int, <-chan error) {
+	numbers := make(chan int)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(numbers)
+		for {
+			req, err := stream.Recv()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				errc <- err
+				cancel()
+				return
+			}
+			for _, n := range []int64{req.A, req.B} {
+				select {
+				case numbers <- int(n):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return numbers, errc
+}
+
+//makeGRPCSumStreamClient 把 numbers 中的数字逐个发送给服务端，numbers 关闭后等待服务端返回总和
+//流中的数据只能读取一次，所以这个 endpoint 不能和 lb.Retry 一起使用
+func makeGRPCSumStreamClient(conn *grpc.ClientConn, otelTracer trace.Tracer) endpoint.Endpoint {
+	client := pb.NewAddClient(conn)
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(addendpoint.SumStreamRequest)
+		if otelTracer != nil {
+			var span trace.Span
+			ctx, span = otelStartClientSpan(ctx, otelTracer, "/pb.Add/SumStream")
+			defer func() { endOTelSpan(span, err) }()
+		}
+
+		// 提前返回时剩下的数字由 addendpoint.Set.SumStream 读完
+		stream, err := client.SumStream(streamOutgoingContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		for n := range req.Numbers {
+			if err := stream.Send(&pb.SumRequest{A: int64(n)}); err != nil {
+				if err != io.EOF {
+					return nil, err
+				}
+				// 服务端已经提前结束(比如溢出)，真正的结果由 CloseAndRecv 返回
+				break
+			}
+		}
+		reply, err := stream.CloseAndRecv()
+		if err != nil {
+			return nil, err
+		}
+		return decodeGRPCSumResponse(ctx, reply)
+	}
+}
+
+// streamContext 流式 RPC 不经过 grpctransport.Server，需要自己取出客户端证书的 subject 和 JWT
+func streamContext(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return kitjwt.GRPCToContext()(withPeerSubject(ctx), md)
+}
+
+// streamOutgoingContext 和 kitjwt.ContextToGRPC 一样，把 context 中的 JWT 放到 authorization metadata 中
+func streamOutgoingContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	ctx = kitjwt.ContextToGRPC()(ctx, &md)
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+//streamServer 和 grpctransport.Server 类似，用于双向流：对流中的每条请求调用一次 endpoint，
+//并在同一个流上返回一条响应。除了认证失败、限流和熔断，解码、endpoint 和编码的错误由 errorEncoder 编码成响应，不会中断流
+type streamServer struct {
+	e            endpoint.Endpoint
+	dec          grpctransport.DecodeRequestFunc
+	enc          grpctransport.EncodeResponseFunc
+	errorEncoder streamErrorEncoder
+	errorHandler transport.ErrorHandler
+}
+
+//streamErrorEncoder 将单条消息的错误编码成一条 gRPC 响应
+type streamErrorEncoder func(ctx context.Context, err error) interface{}
+
+func newStreamServer(e endpoint.Endpoint, dec grpctransport.DecodeRequestFunc, enc grpctransport.EncodeResponseFunc, errorEncoder streamErrorEncoder, errorHandler transport.ErrorHandler) streamServer {
+	return streamServer{e: e, dec: dec, enc: enc, errorEncoder: errorEncoder, errorHandler: errorHandler}
+}
+
+//ServeStream recv 返回 io.EOF 时说明客户端发送完毕，正常结束；recv 和 send 的错误会结束整个流
+func (s streamServer) ServeStream(ctx context.Context, recv func() (interface{}, error), send func(interface{}) error) error {
+	for {
+		req, err := recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		reply, err := s.serveOne(ctx, req)
+		if err != nil {
+			return err
+		}
+		if err := send(reply); err != nil {
+			return err
+		}
+	}
+}
+
+// serveOne 认证失败、被限流或熔断拒绝时和一元 RPC 一样返回 err2status 的状态码并结束整个流，
+// 客户端根据 ResourceExhausted 和 Unavailable 决定是否稍后重新打开流
+func (s streamServer) serveOne(ctx context.Context, req interface{}) (interface{}, error) {
+	request, err := s.dec(ctx, req)
+	if err != nil {
+		s.errorHandler.Handle(ctx, err)
+		return s.errorEncoder(ctx, err), nil
+	}
+	response, err := s.e(ctx, request)
+	if err != nil {
+		s.errorHandler.Handle(ctx, err)
+		if serr := err2status(err); serr != err {
+			return nil, serr
+		}
+		return s.errorEncoder(ctx, err), nil
+	}
+	reply, err := s.enc(ctx, response)
+	if err != nil {
+		s.errorHandler.Handle(ctx, err)
+		return s.errorEncoder(ctx, err), nil
+	}
+	return reply, nil
+}
+
+//ConcatStream 每条 ConcatRequest 都经过 ConcatEndpoint，和一元的 Concat 使用同样的限流、熔断等中间件
+func (s *grpcServer) ConcatStream(stream pb.Add_ConcatStreamServer) (err error) {
+	ctx := streamContext(stream.Context())
+	if s.otelTracer != nil {
+		var span trace.Span
+		ctx, span = otelStartServerSpan(ctx, s.otelTracer, "/pb.Add/ConcatStream")
+		defer func() { endOTelSpan(span, err) }()
+	}
+	return s.concatStream.ServeStream(ctx,
+		func() (interface{}, error) { return stream.Recv() },
+		func(reply interface{}) error { return stream.Send(reply.(*pb.ConcatReply)) },
+	)
+}
+
+// encodeGRPCConcatStreamError 业务错误和解码、编码的错误放在 ConcatReply 中返回，限流和熔断见 streamServer.serveOne
+func encodeGRPCConcatStreamError(_ context.Context, err error) interface{} {
+	msg, code := encodeError(err)
+	return &pb.ConcatReply{Err: msg, Code: code}
+}
+
+//ConcatStream 是 ConcatStream RPC 的客户端，响应和请求按顺序一一对应
+//Send 和 Recv 可以在不同的 goroutine 中调用，这样可以连续发送请求而不用等待上一个响应
+type ConcatStream struct {
+	stream pb.Add_ConcatStreamClient
+	cancel context.CancelFunc
+	end    func(error)
+}
+
+//NewGRPCConcatStream 在 conn 上打开一个 ConcatStream 流，otelTracer 不为 nil 时整个流对应一个 client span
+func NewGRPCConcatStream(ctx context.Context, conn *grpc.ClientConn, otelTracer trace.Tracer) (*ConcatStream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	end := func(error) {}
+	if otelTracer != nil {
+		var span trace.Span
+		ctx, span = otelStartClientSpan(ctx, otelTracer, "/pb.Add/ConcatStream")
+		end = func(err error) { endOTelSpan(span, err) }
+	}
+	stream, err := pb.NewAddClient(conn).ConcatStream(streamOutgoingContext(ctx))
+	if err != nil {
+		end(err)
+		cancel()
+		return nil, err
+	}
+	return &ConcatStream{stream: stream, cancel: cancel, end: end}, nil
+}
+
+//Send 发送一个请求
+func (s *ConcatStream) Send(a, b string) error {
+	req, err := encodeGRPCConcatRequest(s.stream.Context(), addendpoint.ConcatRequest{A: a, B: b})
+	if err != nil {
+		return err
+	}
+	return s.stream.Send(req.(*pb.ConcatRequest))
+}
+
+//Recv 按顺序返回下一个响应，单条消息的错误在 ConcatResponse.Err 中，返回的 error 表示整个流出错
+//服务端处理完所有请求后返回 io.EOF
+func (s *ConcatStream) Recv() (addendpoint.ConcatResponse, error) {
+	reply, err := s.stream.Recv()
+	if err != nil {
+		if err == io.EOF {
+			s.end(nil)
+		} else {
+			s.end(err)
+		}
+		s.cancel()
+		return addendpoint.ConcatResponse{}, err
+	}
+	resp, err := decodeGRPCConcatResponse(s.stream.Context(), reply)
+	if err != nil {
+		return addendpoint.ConcatResponse{}, err
+	}
+	return resp.(addendpoint.ConcatResponse), nil
+}
+
+//CloseSend 通知服务端不会再发送请求，之后仍然需要调用 Recv 直到返回 io.EOF
+func (s *ConcatStream) CloseSend() error {
+	return s.stream.CloseSend()
+}
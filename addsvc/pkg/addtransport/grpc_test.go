@@ -0,0 +1,115 @@
+package addtransport
+
+import (
+	"context"
+	"kitdemo/addsvc/pb"
+	"kitdemo/addsvc/pkg/addendpoint"
+	"kitdemo/addsvc/pkg/addservice"
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	stdzipkin "github.com/openzipkin/zipkin-go"
+	"github.com/openzipkin/zipkin-go/model"
+	"github.com/openzipkin/zipkin-go/reporter/recorder"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// startGRPCServer 在本地端口上启动一个安装了所有中间件的 addsvc gRPC 服务，返回连接到它的客户端连接
+func startGRPCServer(t *testing.T, limits addendpoint.Limits, otelTracer trace.Tracer, zipkinTracer *stdzipkin.Tracer) *grpc.ClientConn {
+	t.Helper()
+	svc := addservice.New(log.NewNopLogger(), discard.NewCounter(), discard.NewCounter(), otelTracer, addservice.NewLimitsStore(addservice.DefaultLimits()))
+	return serveGRPC(t, newEndpoints(svc, limits, otelTracer, zipkinTracer), otelTracer, zipkinTracer)
+}
+
+// newEndpoints 和 addsvc 一样给 svc 安装所有的 endpoint 中间件，不开启认证
+func newEndpoints(svc addservice.Service, limits addendpoint.Limits, otelTracer trace.Tracer, zipkinTracer *stdzipkin.Tracer) addendpoint.Set {
+	return addendpoint.New(svc, log.NewNopLogger(), discard.NewHistogram(), discard.NewGauge(), limits, nil, otelTracer, zipkinTracer)
+}
+
+// serveGRPC 在本地端口上提供 endpoints，返回连接到它的客户端连接
+func serveGRPC(t *testing.T, endpoints addendpoint.Set, otelTracer trace.Tracer, zipkinTracer *stdzipkin.Tracer) *grpc.ClientConn {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	pb.RegisterAddServer(server, NewGRPCServer(endpoints, otelTracer, zipkinTracer, log.NewNopLogger()))
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestZipkinGRPCPropagation(t *testing.T) {
+	reporter := recorder.NewReporter()
+	defer reporter.Close()
+	tracer, err := stdzipkin.NewTracer(reporter, stdzipkin.WithSampler(stdzipkin.AlwaysSample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewGRPCClient(startGRPCServer(t, addendpoint.Limits{}, nil, tracer), nil, tracer, nil, log.NewNopLogger())
+
+	if v, err := client.Sum(context.Background(), 1, 2); err != nil || v != 3 {
+		t.Fatalf("Sum(1, 2): want 3, have %d, %v", v, err)
+	}
+
+	spans := reporter.Flush()
+	var clientSpan, serverSpan, endpointSpan *model.SpanModel
+	for i, span := range spans {
+		switch {
+		case span.Kind == model.Client:
+			clientSpan = &spans[i]
+		case span.Kind == model.Server:
+			serverSpan = &spans[i]
+		case span.Name == "Sum":
+			endpointSpan = &spans[i]
+		}
+	}
+	if clientSpan == nil || serverSpan == nil || endpointSpan == nil {
+		t.Fatalf("want client, server and endpoint spans, have %+v", spans)
+	}
+	for _, span := range spans {
+		if span.TraceID != clientSpan.TraceID {
+			t.Errorf("span %q: want trace %s, have %s", span.Name, clientSpan.TraceID, span.TraceID)
+		}
+	}
+	// 服务端默认和客户端共用一个 span，否则客户端的 span 是服务端 span 的父 span
+	if serverSpan.ID != clientSpan.ID && (serverSpan.ParentID == nil || *serverSpan.ParentID != clientSpan.ID) {
+		t.Errorf("server span %s is not joined to client span %s", serverSpan.ID, clientSpan.ID)
+	}
+	if endpointSpan.ParentID == nil || *endpointSpan.ParentID != serverSpan.ID {
+		t.Errorf("endpoint span parent: want %s, have %v", serverSpan.ID, endpointSpan.ParentID)
+	}
+}
+
+func TestConcatStreamRateLimited(t *testing.T) {
+	// 令牌桶只有一个令牌，第二条请求被限流
+	conn := startGRPCServer(t, addendpoint.Limits{RPS: 0.001, Burst: 1}, nil, nil)
+	stream, err := NewGRPCConcatStream(context.Background(), conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := stream.Send("a", "b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if resp, err := stream.Recv(); err != nil || resp.V != "ab" {
+		t.Fatalf("first reply: want ab, have %+v, %v", resp, err)
+	}
+	// 和一元的 Concat 一样返回 ResourceExhausted
+	if _, err := stream.Recv(); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("second reply: want ResourceExhausted, have %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package addtransport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"kitdemo/addsvc/pb"
+	"kitdemo/addsvc/pkg/addendpoint"
+	"kitdemo/addsvc/pkg/addservice"
+	"net/http"
+	"net/url"
+	"strings"
+
+	kitjwt "github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/ratelimit"
+	"github.com/go-kit/kit/transport"
+	"github.com/sony/gobreaker"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+//NewHTTPHandler 将 endpoints 以 HTTP/JSON 的方式暴露出来
+func NewHTTPHandler(endpoints addendpoint.Set, logger log.Logger) http.Handler {
+	options := []httptransport.ServerOption{
+		httptransport.ServerErrorEncoder(errorEncoder),
+		httptransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
+		httptransport.ServerBefore(kitjwt.HTTPToContext()),
+	}
+	m := http.NewServeMux()
+	m.Handle("/sum", httptransport.NewServer(
+		endpoints.SumEndpoint,
+		decodeHTTPSumRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Handle("/concat", httptransport.NewServer(
+		endpoints.ConcatEndpoint,
+		decodeHTTPConcatRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	return m
+}
+
+//NewHTTPClient 返回一个通过 HTTP 访问远端 instance 的 addservice.Service
+func NewHTTPClient(instance string, logger log.Logger) (addservice.Service, error) {
+	if !strings.HasPrefix(instance, "http") {
+		instance = "http://" + instance
+	}
+	u, err := url.Parse(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []httptransport.ClientOption{
+		httptransport.ClientBefore(kitjwt.ContextToHTTP()),
+	}
+
+	var sumEndpoint endpoint.Endpoint
+	{
+		sumEndpoint = httptransport.NewClient(
+			"POST",
+			copyURL(u, "/sum"),
+			encodeHTTPGenericRequest,
+			decodeHTTPSumResponse,
+			options...,
+		).Endpoint()
+	}
+
+	var concatEndpoint endpoint.Endpoint
+	{
+		concatEndpoint = httptransport.NewClient(
+			"POST",
+			copyURL(u, "/concat"),
+			encodeHTTPGenericRequest,
+			decodeHTTPConcatResponse,
+			options...,
+		).Endpoint()
+	}
+
+	return addendpoint.Set{
+		SumEndpoint:       sumEndpoint,
+		ConcatEndpoint:    concatEndpoint,
+		SumStreamEndpoint: unsupportedStreamEndpoint,
+	}, nil
+}
+
+func copyURL(base *url.URL, path string) *url.URL {
+	next := *base
+	next.Path = path
+	return &next
+}
+
+func errorEncoder(_ context.Context, err error, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	msg, code := encodeError(err)
+	w.WriteHeader(err2code(err, code))
+	json.NewEncoder(w).Encode(errorWrapper{Error: msg, Code: code.String()})
+}
+
+// errBadRequest 请求体无法解码，属于客户端的错误
+var errBadRequest = errors.New("bad request")
+
+// err2code 认证失败、被限流和熔断拒绝的请求有专门的状态码，业务逻辑的错误和无法解码的请求属于客户端的错误，其他的错误都当作服务端的错误
+func err2code(err error, code pb.ErrorCode) int {
+	switch {
+	case errors.Is(err, errBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, addendpoint.ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, ratelimit.ErrLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, gobreaker.ErrOpenState), errors.Is(err, gobreaker.ErrTooManyRequests):
+		return http.StatusServiceUnavailable
+	case code == pb.ErrorCode_UNKNOWN:
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+func errorDecoder(r *http.Response) error {
+	var w errorWrapper
+	if err := json.NewDecoder(r.Body).Decode(&w); err != nil {
+		return err
+	}
+	return decodeError(w.Error, pb.ErrorCode(pb.ErrorCode_value[w.Code]))
+}
+
+type errorWrapper struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+func decodeHTTPSumRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req addendpoint.SumRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return req, nil
+}
+
+func decodeHTTPConcatRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req addendpoint.ConcatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return req, nil
+}
+
+func decodeHTTPSumResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, errorDecoder(r)
+	}
+	var resp addendpoint.SumResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+func decodeHTTPConcatResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, errorDecoder(r)
+	}
+	var resp addendpoint.ConcatResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+func encodeHTTPGenericRequest(_ context.Context, r *http.Request, request interface{}) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(request); err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(&buf)
+	return nil
+}
+
+// encodeHTTPGenericResponse 如果响应中包含业务错误，交给 errorEncoder 处理
+func encodeHTTPGenericResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if f, ok := response.(endpoint.Failer); ok && f.Failed() != nil {
+		errorEncoder(ctx, f.Failed(), w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,49 @@
+package addtransport
+
+import (
+	"errors"
+	"kitdemo/addsvc/pkg/addendpoint"
+	"kitdemo/addsvc/pkg/addservice"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+func TestHTTPStatusCodes(t *testing.T) {
+	svc := addservice.New(log.NewNopLogger(), discard.NewCounter(), discard.NewCounter(), nil, addservice.NewLimitsStore(addservice.DefaultLimits()))
+	server := httptest.NewServer(NewHTTPHandler(newEndpoints(svc, addendpoint.Limits{}, nil, nil), log.NewNopLogger()))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		path, body string
+		want       int
+	}{
+		{"/sum", `{"a":1,"b":2}`, http.StatusOK},
+		{"/sum", `{"a":1,`, http.StatusBadRequest},
+		{"/concat", `not json`, http.StatusBadRequest},
+		{"/concat", ``, http.StatusBadRequest},
+	} {
+		resp, err := http.Post(server.URL+tc.path, "application/json", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s %q: want %d, have %d", tc.path, tc.body, tc.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestHTTPSumStreamUnsupportedDrains(t *testing.T) {
+	svc, err := NewHTTPClient("localhost:1", log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sumStream(t, svc, 100); !errors.Is(err, ErrStreamingUnsupported) {
+		t.Errorf("want ErrStreamingUnsupported, have %v", err)
+	}
+}
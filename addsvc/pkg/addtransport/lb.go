@@ -0,0 +1,181 @@
+package addtransport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"kitdemo/addsvc/pkg/addendpoint"
+	"kitdemo/addsvc/pkg/addservice"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	stdzipkin "github.com/openzipkin/zipkin-go"
+	"github.com/sony/gobreaker"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//NewBalancedGRPCClient 为每个 conn 创建一个 gRPC 客户端，每个方法在所有实例之间轮询
+//每个实例都有自己的熔断器，调用失败时在 maxTime 内最多尝试 maxAttempts 次，业务错误和流式方法不会重试
+//认证失败、被限流等换一个实例也不会成功的错误既不重试也不计入熔断，见 retryable
+func NewBalancedGRPCClient(conns []*grpc.ClientConn, maxAttempts int, maxTime time.Duration, otelTracer trace.Tracer, zipkinTracer *stdzipkin.Tracer, clientMetrics *ClientMetrics, logger log.Logger) addservice.Service {
+	var sumEndpointer, concatEndpointer, sumStreamEndpointer sd.FixedEndpointer
+	for _, conn := range conns {
+		set := newGRPCClientSet(conn, otelTracer, zipkinTracer, clientMetrics, logger)
+		sumEndpointer = append(sumEndpointer, instanceBreaker(conn.Target(), "Sum")(set.SumEndpoint))
+		concatEndpointer = append(concatEndpointer, instanceBreaker(conn.Target(), "Concat")(set.ConcatEndpoint))
+		sumStreamEndpointer = append(sumStreamEndpointer, instanceBreaker(conn.Target(), "SumStream")(set.SumStreamEndpoint))
+	}
+	logger.Log("balance", "round-robin", "instances", len(conns))
+
+	return addendpoint.Set{
+		SumEndpoint:    retry(maxAttempts, maxTime, lb.NewRoundRobin(sumEndpointer)),
+		ConcatEndpoint: retry(maxAttempts, maxTime, lb.NewRoundRobin(concatEndpointer)),
+		// 流中的数据只能读取一次，流式方法只轮询不重试
+		SumStreamEndpoint: balanced(lb.NewRoundRobin(sumStreamEndpointer)),
+	}
+}
+
+//NewInstancerGRPCClient 和 NewBalancedGRPCClient 一样，但是实例来自 instancer，实例增加或减少时不需要重启
+//每个实例只用 dial 建立一个连接，所有方法共用，实例下线后连接会被关闭
+func NewInstancerGRPCClient(instancer sd.Instancer, dial func(instance string) (*grpc.ClientConn, error), maxAttempts int, maxTime time.Duration, otelTracer trace.Tracer, zipkinTracer *stdzipkin.Tracer, clientMetrics *ClientMetrics, logger log.Logger) addservice.Service {
+	pool := &connPool{dial: dial, conns: map[string]*pooledConn{}}
+	endpointer := func(method string, pick func(addendpoint.Set) endpoint.Endpoint) sd.Endpointer {
+		factory := func(instance string) (endpoint.Endpoint, io.Closer, error) {
+			conn, closer, err := pool.get(instance)
+			if err != nil {
+				return nil, nil, err
+			}
+			e := pick(newGRPCClientSet(conn, otelTracer, zipkinTracer, clientMetrics, logger))
+			return instanceBreaker(instance, method)(e), closer, nil
+		}
+		return sd.NewEndpointer(instancer, factory, log.With(logger, "method", method))
+	}
+	sumEndpointer := endpointer("Sum", func(s addendpoint.Set) endpoint.Endpoint { return s.SumEndpoint })
+	concatEndpointer := endpointer("Concat", func(s addendpoint.Set) endpoint.Endpoint { return s.ConcatEndpoint })
+	sumStreamEndpointer := endpointer("SumStream", func(s addendpoint.Set) endpoint.Endpoint { return s.SumStreamEndpoint })
+
+	return addendpoint.Set{
+		SumEndpoint:       retry(maxAttempts, maxTime, lb.NewRoundRobin(sumEndpointer)),
+		ConcatEndpoint:    retry(maxAttempts, maxTime, lb.NewRoundRobin(concatEndpointer)),
+		SumStreamEndpoint: balanced(lb.NewRoundRobin(sumStreamEndpointer)),
+	}
+}
+
+// connPool 每个方法的 endpointer 都会为同一个实例调用一次 factory，用引用计数让它们共用一个连接
+type connPool struct {
+	dial func(instance string) (*grpc.ClientConn, error)
+
+	mu    sync.Mutex
+	conns map[string]*pooledConn
+}
+
+type pooledConn struct {
+	conn *grpc.ClientConn
+	refs int
+}
+
+func (p *connPool) get(instance string) (*grpc.ClientConn, io.Closer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.conns[instance]
+	if !ok {
+		conn, err := p.dial(instance)
+		if err != nil {
+			return nil, nil, err
+		}
+		c = &pooledConn{conn: conn}
+		p.conns[instance] = c
+	}
+	c.refs++
+	return c.conn, releaser{p, instance}, nil
+}
+
+func (p *connPool) release(instance string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.conns[instance]
+	if !ok {
+		return nil
+	}
+	if c.refs--; c.refs > 0 {
+		return nil
+	}
+	delete(p.conns, instance)
+	return c.conn.Close()
+}
+
+type releaser struct {
+	pool     *connPool
+	instance string
+}
+
+func (r releaser) Close() error { return r.pool.release(r.instance) }
+
+// balanced 每次调用从 balancer 中取一个 endpoint，失败时不重试
+func balanced(b lb.Balancer) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		e, err := b.Endpoint()
+		if err != nil {
+			return nil, err
+		}
+		return e(ctx, request)
+	}
+}
+
+// retry 和 lb.Retry 一样在 maxTime 内最多尝试 maxAttempts 次，但是 retryable 为 false 的错误马上返回
+// 返回的是最后一次的错误而不是 lb.RetryError，调用方可以用 status.Code 取出 gRPC 状态码
+func retry(maxAttempts int, maxTime time.Duration, b lb.Balancer) endpoint.Endpoint {
+	e := lb.RetryWithCallback(maxTime, b, func(n int, err error) (bool, error) {
+		return n < maxAttempts && retryable(err), nil
+	})
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		response, err := e(ctx, request)
+		var retryErr lb.RetryError
+		if errors.As(err, &retryErr) {
+			return nil, retryErr.Final
+		}
+		return response, err
+	}
+}
+
+// retryable 只有实例本身的问题(比如实例不可用、熔断器打开)才值得换一个实例重试，
+// 认证失败、被限流、参数错误、调用方取消等在哪个实例上都一样会失败
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.PermissionDenied, codes.InvalidArgument, codes.ResourceExhausted,
+		codes.FailedPrecondition, codes.OutOfRange, codes.Unimplemented, codes.Canceled:
+		return false
+	}
+	return true
+}
+
+// instanceBreaker 每个实例每个方法一个熔断器，只有 retryable 的错误才算失败，一个错误的 token 不会打开所有实例的熔断器
+func instanceBreaker(instance, method string) endpoint.Middleware {
+	cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name: instance + "/" + method,
+	})
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			called := false
+			_, cbErr := cb.Execute(func() (interface{}, error) {
+				called = true
+				response, err = next(ctx, request)
+				if err != nil && retryable(err) {
+					return nil, err
+				}
+				return nil, nil
+			})
+			if !called {
+				return nil, cbErr
+			}
+			return response, err
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package addtransport
+
+import (
+	"context"
+	"errors"
+	"kitdemo/addsvc/pb"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/sony/gobreaker"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sumStream 用不带缓冲的 channel 发送 count 个数字，发送方阻塞超过 1 秒时测试失败
+func sumStream(t *testing.T, svc interface {
+	SumStream(context.Context, <-chan int) (int, error)
+}, count int) error {
+	t.Helper()
+	numbers := make(chan int)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		defer close(numbers)
+		for i := 1; i <= count; i++ {
+			numbers <- i
+		}
+	}()
+	_, err := svc.SumStream(context.Background(), numbers)
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatalf("producer blocked after SumStream returned %v", err)
+	}
+	return err
+}
+
+func TestSumStreamNoEndpointsDrains(t *testing.T) {
+	svc := NewBalancedGRPCClient(nil, 3, time.Second, nil, nil, nil, log.NewNopLogger())
+	if err := sumStream(t, svc, 100); !errors.Is(err, lb.ErrNoEndpoints) {
+		t.Errorf("want ErrNoEndpoints, have %v", err)
+	}
+}
+
+func TestSumStreamOpenBreakerDrains(t *testing.T) {
+	// 没有服务在监听的地址，每次调用都失败，gobreaker 默认连续失败 6 次后打开
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis.Close()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	svc := NewBalancedGRPCClient([]*grpc.ClientConn{conn}, 3, time.Second, nil, nil, nil, log.NewNopLogger())
+
+	for i := 0; i < 6; i++ {
+		if err := sumStream(t, svc, 100); err == nil {
+			t.Fatalf("call %d: want an error from the missing server", i)
+		}
+	}
+	if err := sumStream(t, svc, 100); !errors.Is(err, gobreaker.ErrOpenState) {
+		t.Errorf("want ErrOpenState, have %v", err)
+	}
+}
+
+// statusServer Sum 总是返回 code，记录被调用的次数
+type statusServer struct {
+	pb.UnimplementedAddServer
+	code  codes.Code
+	calls int32
+}
+
+func (s *statusServer) Sum(context.Context, *pb.SumRequest) (*pb.SumReply, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return nil, status.Error(s.code, s.code.String())
+}
+
+// startStatusServers 启动 n 个 Sum 总是返回 code 的服务
+func startStatusServers(t *testing.T, n int, code codes.Code) ([]*statusServer, []*grpc.ClientConn) {
+	var (
+		servers []*statusServer
+		conns   []*grpc.ClientConn
+	)
+	for i := 0; i < n; i++ {
+		s := &statusServer{code: code}
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := grpc.NewServer()
+		pb.RegisterAddServer(server, s)
+		go server.Serve(lis)
+		t.Cleanup(server.Stop)
+		conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		servers, conns = append(servers, s), append(conns, conn)
+	}
+	return servers, conns
+}
+
+func totalCalls(servers []*statusServer) int {
+	var n int
+	for _, s := range servers {
+		n += int(atomic.LoadInt32(&s.calls))
+	}
+	return n
+}
+
+func TestBalancedClientDoesNotRetryNonRetryable(t *testing.T) {
+	for _, code := range []codes.Code{codes.Unauthenticated, codes.ResourceExhausted, codes.InvalidArgument} {
+		servers, conns := startStatusServers(t, 2, code)
+		svc := NewBalancedGRPCClient(conns, 3, time.Second, nil, nil, nil, log.NewNopLogger())
+		// 调用次数超过 gobreaker 默认的 6 次，熔断器也不会打开
+		for i := 0; i < 10; i++ {
+			if _, err := svc.Sum(context.Background(), 1, 2); status.Code(err) != code {
+				t.Fatalf("%s call %d: want %s, have %v", code, i, code, err)
+			}
+		}
+		if want, have := 10, totalCalls(servers); want != have {
+			t.Errorf("%s: want %d calls, have %d", code, want, have)
+		}
+	}
+}
+
+func TestBalancedClientRetriesUnavailable(t *testing.T) {
+	servers, conns := startStatusServers(t, 2, codes.Unavailable)
+	svc := NewBalancedGRPCClient(conns, 3, time.Second, nil, nil, nil, log.NewNopLogger())
+	if _, err := svc.Sum(context.Background(), 1, 2); status.Code(err) != codes.Unavailable {
+		t.Errorf("want Unavailable, have %v", err)
+	}
+	if want, have := 3, totalCalls(servers); want != have {
+		t.Errorf("want %d attempts, have %d", want, have)
+	}
+}
@@ -0,0 +1,89 @@
+package addtransport
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/status"
+)
+
+//ClientMetrics gRPC 客户端看到的指标，包括网络耗时，所有指标都有 method 标签
+//Errors 还有 code 标签，传输层错误是 gRPC 状态码，业务错误是 pb.ErrorCode
+type ClientMetrics struct {
+	Duration metrics.Histogram
+	Errors   metrics.Counter
+	InFlight metrics.Gauge
+}
+
+//NewClientMetrics 创建客户端指标并注册到 registerer，registerer 为 nil 时注册到 Prometheus 默认的 registry
+func NewClientMetrics(registerer stdprometheus.Registerer) (*ClientMetrics, error) {
+	if registerer == nil {
+		registerer = stdprometheus.DefaultRegisterer
+	}
+	duration := stdprometheus.NewHistogramVec(stdprometheus.HistogramOpts{
+		Namespace: "example",
+		Subsystem: "addsvc_client",
+		Name:      "request_duration_seconds",
+		Help:      "客户端每一次调用的耗时，包括网络耗时，重试时每一次分别记录",
+		Buckets:   stdprometheus.DefBuckets,
+	}, []string{"method"})
+	errors := stdprometheus.NewCounterVec(stdprometheus.CounterOpts{
+		Namespace: "example",
+		Subsystem: "addsvc_client",
+		Name:      "errors_total",
+		Help:      "客户端收到的错误数",
+	}, []string{"method", "code"})
+	inFlight := stdprometheus.NewGaugeVec(stdprometheus.GaugeOpts{
+		Namespace: "example",
+		Subsystem: "addsvc_client",
+		Name:      "in_flight_requests",
+		Help:      "正在进行中的请求数",
+	}, []string{"method"})
+	for _, c := range []stdprometheus.Collector{duration, errors, inFlight} {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return &ClientMetrics{
+		Duration: prometheus.NewHistogram(duration),
+		Errors:   prometheus.NewCounter(errors),
+		InFlight: prometheus.NewGauge(inFlight),
+	}, nil
+}
+
+// instrument 记录每一次调用，m 为 nil 时不做任何事
+func (m *ClientMetrics) instrument(method string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		if m == nil {
+			return next
+		}
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			inFlight := m.InFlight.With("method", method)
+			inFlight.Add(1)
+			defer func(begin time.Time) {
+				inFlight.Add(-1)
+				m.Duration.With("method", method).Observe(time.Since(begin).Seconds())
+				if code := clientErrorCode(response, err); code != "" {
+					m.Errors.With("method", method, "code", code).Add(1)
+				}
+			}(time.Now())
+			return next(ctx, request)
+		}
+	}
+}
+
+// clientErrorCode 没有错误时返回空字符串
+func clientErrorCode(response interface{}, err error) string {
+	if err != nil {
+		return status.Code(err).String()
+	}
+	if f, ok := response.(endpoint.Failer); ok && f.Failed() != nil {
+		_, code := encodeError(f.Failed())
+		return code.String()
+	}
+	return ""
+}
@@ -0,0 +1,152 @@
+package addtransport
+
+import (
+	"context"
+	"encoding/json"
+	"kitdemo/addsvc/pb"
+	"kitdemo/addsvc/pkg/addendpoint"
+	"kitdemo/addsvc/pkg/addservice"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/transport"
+	"github.com/nats-io/nats.go"
+
+	natstransport "github.com/go-kit/kit/transport/nats"
+)
+
+const (
+	natsSumSubject    = "addsvc.sum"
+	natsConcatSubject = "addsvc.concat"
+)
+
+//NATSServer 持有 Sum 和 Concat 的 NATS 订阅者
+type NATSServer struct {
+	sum    *natstransport.Subscriber
+	concat *natstransport.Subscriber
+}
+
+func NewNATSServer(endpoints addendpoint.Set, logger log.Logger) *NATSServer {
+	options := []natstransport.SubscriberOption{
+		natstransport.SubscriberErrorHandler(transport.NewLogErrorHandler(logger)),
+	}
+	return &NATSServer{
+		sum: natstransport.NewSubscriber(
+			endpoints.SumEndpoint,
+			decodeNATSSumRequest,
+			encodeNATSSumResponse,
+			options...,
+		),
+		concat: natstransport.NewSubscriber(
+			endpoints.ConcatEndpoint,
+			decodeNATSConcatRequest,
+			encodeNATSConcatResponse,
+			options...,
+		),
+	}
+}
+
+//Subscribe 以队列组的方式订阅，同一个 queue 中的多个 worker 会分摊请求，客户端不需要任何改动
+func (s *NATSServer) Subscribe(nc *nats.Conn, queue string) ([]*nats.Subscription, error) {
+	var subs []*nats.Subscription
+	for subject, sub := range map[string]*natstransport.Subscriber{
+		natsSumSubject:    s.sum,
+		natsConcatSubject: s.concat,
+	} {
+		ns, err := nc.QueueSubscribe(subject, queue, sub.ServeMsg(nc))
+		if err != nil {
+			for _, prev := range subs {
+				prev.Unsubscribe()
+			}
+			return nil, err
+		}
+		subs = append(subs, ns)
+	}
+	return subs, nil
+}
+
+func NewNATSClient(nc *nats.Conn, logger log.Logger) addservice.Service {
+	var options []natstransport.PublisherOption
+
+	var sumEndpoint endpoint.Endpoint
+	{
+		sumEndpoint = natstransport.NewPublisher(
+			nc,
+			natsSumSubject,
+			natstransport.EncodeJSONRequest,
+			decodeNATSSumResponse,
+			options...,
+		).Endpoint()
+	}
+
+	var concatEndpoint endpoint.Endpoint
+	{
+		concatEndpoint = natstransport.NewPublisher(
+			nc,
+			natsConcatSubject,
+			natstransport.EncodeJSONRequest,
+			decodeNATSConcatResponse,
+			options...,
+		).Endpoint()
+	}
+
+	return addendpoint.Set{
+		SumEndpoint:       sumEndpoint,
+		ConcatEndpoint:    concatEndpoint,
+		SumStreamEndpoint: unsupportedStreamEndpoint,
+	}
+}
+
+// natsSumReply 和 natsConcatReply 是 NATS 上传输的响应，错误和 pb 中一样用错误信息加错误码表示
+// err 字段名和 natstransport.DefaultErrorEncoder 保持一致，这样传输层的错误也能被解析出来
+type natsSumReply struct {
+	V    int    `json:"v"`
+	Err  string `json:"err,omitempty"`
+	Code string `json:"code,omitempty"`
+}
+
+type natsConcatReply struct {
+	V    string `json:"v"`
+	Err  string `json:"err,omitempty"`
+	Code string `json:"code,omitempty"`
+}
+
+func decodeNATSSumRequest(_ context.Context, msg *nats.Msg) (interface{}, error) {
+	var req addendpoint.SumRequest
+	err := json.Unmarshal(msg.Data, &req)
+	return req, err
+}
+
+func decodeNATSConcatRequest(_ context.Context, msg *nats.Msg) (interface{}, error) {
+	var req addendpoint.ConcatRequest
+	err := json.Unmarshal(msg.Data, &req)
+	return req, err
+}
+
+func encodeNATSSumResponse(ctx context.Context, reply string, nc *nats.Conn, response interface{}) error {
+	resp := response.(addendpoint.SumResponse)
+	msg, code := encodeError(resp.Err)
+	return natstransport.EncodeJSONResponse(ctx, reply, nc, natsSumReply{V: resp.V, Err: msg, Code: code.String()})
+}
+
+func encodeNATSConcatResponse(ctx context.Context, reply string, nc *nats.Conn, response interface{}) error {
+	resp := response.(addendpoint.ConcatResponse)
+	msg, code := encodeError(resp.Err)
+	return natstransport.EncodeJSONResponse(ctx, reply, nc, natsConcatReply{V: resp.V, Err: msg, Code: code.String()})
+}
+
+func decodeNATSSumResponse(_ context.Context, msg *nats.Msg) (interface{}, error) {
+	var resp natsSumReply
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return nil, err
+	}
+	return addendpoint.SumResponse{V: resp.V, Err: decodeError(resp.Err, pb.ErrorCode(pb.ErrorCode_value[resp.Code]))}, nil
+}
+
+func decodeNATSConcatResponse(_ context.Context, msg *nats.Msg) (interface{}, error) {
+	var resp natsConcatReply
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return nil, err
+	}
+	return addendpoint.ConcatResponse{V: resp.V, Err: decodeError(resp.Err, pb.ErrorCode(pb.ErrorCode_value[resp.Code]))}, nil
+}
@@ -0,0 +1,113 @@
+package addtransport
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+)
+
+// otelPropagator 使用 W3C Trace Context，也就是 traceparent 和 tracestate 两个 header
+var otelPropagator = propagation.TraceContext{}
+
+//otelGRPCServerTrace 从 gRPC metadata 中解析出 traceparent，为每个请求创建一个 server span
+func otelGRPCServerTrace(tracer trace.Tracer) grpctransport.ServerOption {
+	serverBefore := grpctransport.ServerBefore(
+		func(ctx context.Context, md metadata.MD) context.Context {
+			ctx = otelPropagator.Extract(ctx, metadataCarrier(md))
+			ctx, _ = tracer.Start(ctx, grpcMethodName(ctx), trace.WithSpanKind(trace.SpanKindServer))
+			return ctx
+		},
+	)
+	serverFinalizer := grpctransport.ServerFinalizer(
+		func(ctx context.Context, err error) {
+			endOTelSpan(trace.SpanFromContext(ctx), err)
+		},
+	)
+	return func(s *grpctransport.Server) {
+		serverBefore(s)
+		serverFinalizer(s)
+	}
+}
+
+//otelGRPCClientTrace 为每次调用创建一个 client span，并将 traceparent 放到 gRPC metadata 中
+func otelGRPCClientTrace(tracer trace.Tracer) grpctransport.ClientOption {
+	clientBefore := grpctransport.ClientBefore(
+		func(ctx context.Context, md *metadata.MD) context.Context {
+			ctx, _ = tracer.Start(ctx, grpcMethodName(ctx), trace.WithSpanKind(trace.SpanKindClient))
+			otelPropagator.Inject(ctx, metadataCarrier(*md))
+			return ctx
+		},
+	)
+	clientFinalizer := grpctransport.ClientFinalizer(
+		func(ctx context.Context, err error) {
+			endOTelSpan(trace.SpanFromContext(ctx), err)
+		},
+	)
+	return func(c *grpctransport.Client) {
+		clientBefore(c)
+		clientFinalizer(c)
+	}
+}
+
+//otelStartServerSpan 流式 RPC 不经过 grpctransport.Server，直接从 incoming metadata 中解析 traceparent
+func otelStartServerSpan(ctx context.Context, tracer trace.Tracer, name string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otelPropagator.Extract(ctx, metadataCarrier(md))
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+//otelStartClientSpan 流式 RPC 不经过 grpctransport.Client，直接将 traceparent 放到 outgoing metadata 中
+func otelStartClientSpan(ctx context.Context, tracer trace.Tracer, name string) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	otelPropagator.Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md), span
+}
+
+func endOTelSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// grpcMethodName 服务端的方法名由 grpctransport.Interceptor 放到 context 中，客户端由 grpctransport.Client 放入
+func grpcMethodName(ctx context.Context) string {
+	if name, ok := ctx.Value(grpctransport.ContextKeyRequestMethod).(string); ok {
+		return name
+	}
+	return "grpc"
+}
+
+// metadataCarrier 让 propagation.TextMapPropagator 可以读写 gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,84 @@
+package addtransport
+
+import (
+	"context"
+	"kitdemo/addsvc/pkg/addendpoint"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestOTelGRPCPropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer tp.Shutdown(context.Background())
+	// 客户端和服务端使用不同的 tracer，span 之间只能通过 metadata 中的 traceparent 关联
+	serverTracer, clientTracer := tp.Tracer("server"), tp.Tracer("client")
+	client := NewGRPCClient(startGRPCServer(t, addendpoint.Limits{}, serverTracer, nil), clientTracer, nil, nil, log.NewNopLogger())
+
+	if v, err := client.Sum(context.Background(), 1, 2); err != nil || v != 3 {
+		t.Fatalf("Sum(1, 2): want 3, have %d, %v", v, err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		switch span.SpanKind() {
+		case trace.SpanKindClient:
+			spans["client"] = span
+		case trace.SpanKindServer:
+			spans["server"] = span
+		default:
+			spans[span.Name()] = span
+		}
+	}
+	// 每一层的 span 都是上一层的子 span
+	for _, tc := range []struct{ child, parent string }{
+		{"server", "client"},
+		{"Sum", "server"},
+		{"addservice.Sum", "Sum"},
+	} {
+		child, parent := spans[tc.child], spans[tc.parent]
+		if child == nil || parent == nil {
+			t.Fatalf("missing %s or %s span, have %v", tc.child, tc.parent, spans)
+		}
+		if want, have := parent.SpanContext().TraceID(), child.SpanContext().TraceID(); want != have {
+			t.Errorf("%s span: want trace %s, have %s", tc.child, want, have)
+		}
+		if want, have := parent.SpanContext().SpanID(), child.Parent().SpanID(); want != have {
+			t.Errorf("%s span: want parent %s, have %s", tc.child, want, have)
+		}
+	}
+	if !spans["server"].Parent().IsRemote() {
+		t.Error("server span parent should come from the traceparent metadata")
+	}
+}
+
+func TestOTelTracesRejectedCalls(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer tp.Shutdown(context.Background())
+	// 令牌桶只有一个令牌，第二个请求被限流
+	conn := startGRPCServer(t, addendpoint.Limits{RPS: 0.001, Burst: 1}, tp.Tracer("server"), nil)
+	client := NewGRPCClient(conn, nil, nil, nil, log.NewNopLogger())
+
+	if _, err := client.Sum(context.Background(), 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Sum(context.Background(), 1, 2); err == nil {
+		t.Fatal("want rate limit error")
+	}
+
+	var statuses []codes.Code
+	for _, span := range recorder.Ended() {
+		if span.Name() == "Sum" {
+			statuses = append(statuses, span.Status().Code)
+		}
+	}
+	if len(statuses) != 2 || statuses[1] != codes.Error {
+		t.Errorf("want two Sum spans, the second with an error, have %v", statuses)
+	}
+}
@@ -0,0 +1,171 @@
+package addtransport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"kitdemo/addsvc/pkg/addendpoint"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+)
+
+//TLSFiles 证书相关的文件，CAFile 在服务端用来验证客户端证书，在客户端用来验证服务端证书
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+//NewServerTLSConfig 每次握手时检查文件是否被修改过，修改后重新加载证书和 CA，不需要重启服务
+//verifyClient 为 true 时要求客户端提供 CA 签发的证书，否则客户端提供了证书才验证
+func NewServerTLSConfig(files TLSFiles, verifyClient bool, logger log.Logger) (*tls.Config, error) {
+	if files.CertFile == "" || files.KeyFile == "" {
+		return nil, errors.New("TLS requires both a certificate and a key")
+	}
+	if verifyClient && files.CAFile == "" {
+		return nil, errors.New("client certificate verification requires a CA")
+	}
+	r := &certReloader{files: files, logger: logger}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	clientAuth := tls.VerifyClientCertIfGiven
+	if verifyClient {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.get()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   clientAuth,
+			}, nil
+		},
+	}, nil
+}
+
+//NewClientTLSConfig CAFile 为空时使用系统的根证书，CertFile 不为空时向服务端出示客户端证书
+//客户端证书会在文件修改后重新加载，CA 只在创建时加载一次
+func NewClientTLSConfig(files TLSFiles, serverName string, logger log.Logger) (*tls.Config, error) {
+	r := &certReloader{files: files, logger: logger}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	_, pool := r.get()
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+		ServerName: serverName,
+	}
+	if files.CertFile != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.get()
+			return cert, nil
+		}
+	}
+	return config, nil
+}
+
+// certReloader 保存当前使用的证书和 CA，文件的修改时间变化后重新加载，加载失败时继续使用原来的
+type certReloader struct {
+	files  TLSFiles
+	logger log.Logger
+
+	mu      sync.Mutex
+	modTime time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+func (r *certReloader) get() (*tls.Certificate, *x509.CertPool) {
+	if modTime := r.latestModTime(); modTime.After(r.loadedAt()) {
+		if err := r.reload(); err != nil {
+			r.logger.Log("tls", "reload", "err", err)
+		} else {
+			r.logger.Log("tls", "reload", "cert", r.files.CertFile, "ca", r.files.CAFile)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, r.pool
+}
+
+func (r *certReloader) loadedAt() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.modTime
+}
+
+func (r *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{r.files.CertFile, r.files.KeyFile, r.files.CAFile} {
+		if name == "" {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+func (r *certReloader) reload() error {
+	modTime := r.latestModTime()
+	var cert *tls.Certificate
+	if r.files.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if r.files.CAFile != "" {
+		pem, err := ioutil.ReadFile(r.files.CAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.files.CAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.modTime, r.cert, r.pool = modTime, cert, pool
+	return nil
+}
+
+//grpcClientSubject 把已经验证过的客户端证书的 subject 放到 context 中，没有使用 mTLS 时 context 不变
+func grpcClientSubject() grpctransport.ServerOption {
+	return grpctransport.ServerBefore(func(ctx context.Context, _ metadata.MD) context.Context {
+		return withPeerSubject(ctx)
+	})
+}
+
+func withPeerSubject(ctx context.Context) context.Context {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return ctx
+	}
+	return addendpoint.WithClientSubject(ctx, info.State.VerifiedChains[0][0].Subject)
+}
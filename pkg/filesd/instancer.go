@@ -0,0 +1,173 @@
+// Package filesd 从本地文件中读取服务实例列表，实现了 sd.Instancer，不需要 Consul 或 etcd
+package filesd
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"gopkg.in/yaml.v2"
+)
+
+//Instancer 定期检查文件的修改时间，文件变化后重新读取实例列表并通知所有订阅者
+//文件可以是 JSON 或者 YAML，内容是实例地址的列表，或者是包含 instances 列表的对象：
+//
+//	instances:
+//	  - localhost:8001
+//	  - localhost:8002
+type Instancer struct {
+	path   string
+	logger log.Logger
+	quit   chan struct{}
+
+	mtx      sync.Mutex
+	modTime  time.Time
+	state    sd.Event
+	registry map[chan<- sd.Event]struct{}
+}
+
+//NewInstancer 第一次读取文件失败时返回错误，之后每隔 interval 检查一次，读取失败时通知订阅者错误
+func NewInstancer(path string, interval time.Duration, logger log.Logger) (*Instancer, error) {
+	s := &Instancer{
+		path:     path,
+		logger:   log.With(logger, "instancer", "file", "path", path),
+		quit:     make(chan struct{}),
+		registry: map[chan<- sd.Event]struct{}{},
+	}
+	instances, modTime, err := readInstances(path)
+	if err != nil {
+		return nil, err
+	}
+	s.modTime = modTime
+	s.state = sd.Event{Instances: instances}
+	s.logger.Log("instances", len(instances))
+	go s.loop(interval)
+	return s, nil
+}
+
+func (s *Instancer) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.refresh()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Instancer) refresh() {
+	fi, err := os.Stat(s.path)
+	if err == nil && !fi.ModTime().After(s.lastModTime()) {
+		return
+	}
+	instances, modTime, err := readInstances(s.path)
+	if err != nil {
+		// 保留修改时间，文件再次修改之前不会重复读取
+		if fi != nil {
+			modTime = fi.ModTime()
+		}
+		s.update(sd.Event{Err: err}, modTime)
+		return
+	}
+	s.update(sd.Event{Instances: instances}, modTime)
+}
+
+func (s *Instancer) lastModTime() time.Time {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.modTime
+}
+
+// update 和 go-kit 的 instance.Cache 一样，状态没有变化时不通知订阅者
+func (s *Instancer) update(event sd.Event, modTime time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.modTime = modTime
+	if reflect.DeepEqual(s.state, event) {
+		return
+	}
+	if event.Err != nil {
+		s.logger.Log("err", event.Err)
+	} else {
+		s.logger.Log("instances", len(event.Instances), "was", len(s.state.Instances))
+	}
+	s.state = event
+	for ch := range s.registry {
+		ch <- copyEvent(event)
+	}
+}
+
+//Register 实现 sd.Instancer，注册后立即收到当前的实例列表
+func (s *Instancer) Register(ch chan<- sd.Event) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.registry[ch] = struct{}{}
+	ch <- copyEvent(s.state)
+}
+
+//Deregister 实现 sd.Instancer
+func (s *Instancer) Deregister(ch chan<- sd.Event) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.registry, ch)
+}
+
+//Stop 停止检查文件
+func (s *Instancer) Stop() {
+	close(s.quit)
+}
+
+// readInstances JSON 是 YAML 的子集，所以两种格式都用 yaml 解析，空列表表示所有实例都已经下线
+func readInstances(path string) ([]string, time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var instances []string
+	if err := yaml.Unmarshal(b, &instances); err != nil {
+		var file struct {
+			Instances []string `yaml:"instances"`
+		}
+		if err := yaml.UnmarshalStrict(b, &file); err != nil {
+			return nil, time.Time{}, err
+		}
+		instances = file.Instances
+	}
+
+	seen := map[string]bool{}
+	result := []string{}
+	for _, instance := range instances {
+		instance = strings.TrimSpace(instance)
+		if instance == "" || seen[instance] {
+			continue
+		}
+		seen[instance] = true
+		result = append(result, instance)
+	}
+	sort.Strings(result)
+	return result, fi.ModTime(), nil
+}
+
+// copyEvent 每个订阅者都需要自己的一份实例列表，因为订阅者可能会修改它
+func copyEvent(e sd.Event) sd.Event {
+	if e.Instances == nil {
+		return e
+	}
+	instances := make([]string, len(e.Instances))
+	copy(instances, e.Instances)
+	e.Instances = instances
+	return e
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/sony/gobreaker"
+)
+
+// 实例在管理接口中的状态
+const (
+	instanceActive   = "active"
+	instanceDraining = "draining"
+	instanceRemoved  = "removed"
+)
+
+//proxyAdmin 在服务发现得到的实例列表之上叠加管理接口的修改，实现了 sd.Instancer
+//通过管理接口添加的实例和服务发现的实例一起参与负载均衡，删除和排空的实例不再接收新的请求
+//修改通过事件发给 sd.Endpointer，和负载均衡器之间不需要额外的同步
+type proxyAdmin struct {
+	// health 不为 nil 时实例列表中包含健康检查的结果
+	health *healthChecker
+	source sd.Instancer
+	events chan sd.Event
+	stats  *proxyStats
+	logger log.Logger
+
+	mtx        sync.Mutex
+	discovered []string
+	added      map[string]bool
+	removed    map[string]bool
+	draining   map[string]bool
+	state      sd.Event
+	registry   map[chan<- sd.Event]*subscriber
+}
+
+//subscriber 每个订阅者在自己的 goroutine 中接收最新的实例列表，publish 只唤醒它，不会在持有锁时阻塞在订阅者的 channel 上
+type subscriber struct {
+	ch     chan<- sd.Event
+	notify chan struct{}
+	done   chan struct{}
+	exited chan struct{}
+}
+
+//newProxyAdmin source 为 nil 时实例列表只来自管理接口
+func newProxyAdmin(source sd.Instancer, stats *proxyStats, logger log.Logger) *proxyAdmin {
+	a := &proxyAdmin{
+		source:   source,
+		events:   make(chan sd.Event),
+		stats:    stats,
+		logger:   log.With(logger, "admin", "proxy"),
+		added:    map[string]bool{},
+		removed:  map[string]bool{},
+		draining: map[string]bool{},
+		state:    sd.Event{Instances: []string{}},
+		registry: map[chan<- sd.Event]*subscriber{},
+	}
+	if source != nil {
+		go func() {
+			for event := range a.events {
+				a.setSource(event)
+			}
+		}()
+		source.Register(a.events)
+	}
+	return a
+}
+
+// setSource 服务发现出错时继续使用上一次的实例列表
+func (a *proxyAdmin) setSource(event sd.Event) {
+	if event.Err != nil {
+		a.logger.Log("err", event.Err)
+		return
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.discovered = event.Instances
+	a.publish()
+}
+
+// publish 必须在持有锁时调用，实例列表没有变化时不通知订阅者，订阅者由 deliver 发送，publish 不会阻塞
+func (a *proxyAdmin) publish() {
+	instances := []string{}
+	for _, instance := range a.known() {
+		if a.stateOf(instance) == instanceActive {
+			instances = append(instances, instance)
+		}
+	}
+	a.stats.retain(a.known())
+	event := sd.Event{Instances: instances}
+	if reflect.DeepEqual(a.state, event) {
+		return
+	}
+	a.state = event
+	for _, s := range a.registry {
+		select {
+		case s.notify <- struct{}{}:
+		default: // 还没有发送的通知会发送最新的实例列表
+		}
+	}
+}
+
+// deliver 每次被唤醒时在锁外把最新的实例列表发给 s，连续的修改只发送最后的结果，直到 s 被注销
+func (a *proxyAdmin) deliver(s *subscriber) {
+	defer close(s.exited)
+	for {
+		select {
+		case <-s.notify:
+		case <-s.done:
+			return
+		}
+		a.mtx.Lock()
+		event := copyEvent(a.state)
+		a.mtx.Unlock()
+		select {
+		case s.ch <- event:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// known 返回服务发现和管理接口添加的所有实例，包括已经删除的，已经排好序
+func (a *proxyAdmin) known() []string {
+	seen := map[string]bool{}
+	var instances []string
+	for _, instance := range a.discovered {
+		seen[instance] = true
+		instances = append(instances, instance)
+	}
+	for instance := range a.added {
+		if !seen[instance] {
+			instances = append(instances, instance)
+		}
+	}
+	sort.Strings(instances)
+	return instances
+}
+
+func (a *proxyAdmin) stateOf(instance string) string {
+	switch {
+	case a.removed[instance]:
+		return instanceRemoved
+	case a.draining[instance]:
+		return instanceDraining
+	default:
+		return instanceActive
+	}
+}
+
+//Register 实现 sd.Instancer，当前的实例列表和之后的修改都是异步发送的
+func (a *proxyAdmin) Register(ch chan<- sd.Event) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if _, ok := a.registry[ch]; ok {
+		return
+	}
+	s := &subscriber{ch: ch, notify: make(chan struct{}, 1), done: make(chan struct{}), exited: make(chan struct{})}
+	a.registry[ch] = s
+	s.notify <- struct{}{}
+	go a.deliver(s)
+}
+
+//Deregister 实现 sd.Instancer，返回后不会再向 ch 发送，调用方可以关闭 ch
+func (a *proxyAdmin) Deregister(ch chan<- sd.Event) {
+	a.mtx.Lock()
+	s, ok := a.registry[ch]
+	delete(a.registry, ch)
+	a.mtx.Unlock()
+	if ok {
+		close(s.done)
+		<-s.exited
+	}
+}
+
+//SetHealthChecker 之后实例列表中包含 h 的健康检查结果
+func (a *proxyAdmin) SetHealthChecker(h *healthChecker) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.health = h
+}
+
+//Stop 实现 sd.Instancer，不再接收服务发现的更新
+func (a *proxyAdmin) Stop() {
+	if a.source != nil {
+		a.source.Deregister(a.events)
+		close(a.events)
+	}
+}
+
+//Add 添加实例，已经删除或者正在排空的实例重新开始接收请求
+func (a *proxyAdmin) Add(instance string) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	delete(a.removed, instance)
+	delete(a.draining, instance)
+	if !a.inSource(instance) {
+		a.added[instance] = true
+	}
+	a.logger.Log("action", "add", "instance", instance)
+	a.publish()
+}
+
+//Remove 删除实例，服务发现中的实例在重新添加之前也不会再使用，返回 false 表示实例不存在
+func (a *proxyAdmin) Remove(instance string) bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if !a.isKnown(instance) {
+		return false
+	}
+	delete(a.added, instance)
+	delete(a.draining, instance)
+	if a.inSource(instance) {
+		a.removed[instance] = true
+	}
+	a.logger.Log("action", "remove", "instance", instance)
+	a.publish()
+	return true
+}
+
+//Drain 实例不再接收新的请求，已经发出的请求可以正常完成，in_flight 为 0 后可以安全地删除
+func (a *proxyAdmin) Drain(instance string) bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if !a.isKnown(instance) || a.removed[instance] {
+		return false
+	}
+	a.draining[instance] = true
+	a.logger.Log("action", "drain", "instance", instance)
+	a.publish()
+	return true
+}
+
+func (a *proxyAdmin) isKnown(instance string) bool {
+	return a.added[instance] || a.inSource(instance)
+}
+
+func (a *proxyAdmin) inSource(instance string) bool {
+	for _, s := range a.discovered {
+		if s == instance {
+			return true
+		}
+	}
+	return false
+}
+
+//instanceStatus 管理接口返回的实例信息
+type instanceStatus struct {
+	Instance string `json:"instance"`
+	State    string `json:"state"`
+	Source   string `json:"source"`
+	Health   string `json:"health,omitempty"`
+	// Breakers 每个方法的熔断器状态
+	Breakers map[string]string `json:"breakers,omitempty"`
+	Requests int64             `json:"requests"`
+	Failures int64             `json:"failures"`
+	InFlight int64             `json:"in_flight"`
+}
+
+//Instances 返回所有实例的状态，包括删除的
+func (a *proxyAdmin) Instances() []instanceStatus {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	result := []instanceStatus{}
+	for _, instance := range a.known() {
+		status := instanceStatus{Instance: instance, State: a.stateOf(instance), Source: "discovery"}
+		if !a.inSource(instance) {
+			status.Source = "admin"
+		}
+		if a.health != nil {
+			status.Health = a.health.Health(instance)
+		}
+		a.stats.fill(&status)
+		result = append(result, status)
+	}
+	return result
+}
+
+//ServeHTTP 管理接口，实例通过 instance 参数指定：
+//
+//	GET    /instances                    列出所有实例
+//	POST   /instances?instance=host:port 添加实例
+//	DELETE /instances?instance=host:port 删除实例
+//	POST   /instances/drain?instance=... 排空实例
+func (a *proxyAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	instance := r.URL.Query().Get("instance")
+	route := r.Method + " " + r.URL.Path
+	if route != "GET /instances" && instance == "" {
+		http.Error(w, "missing instance parameter", http.StatusBadRequest)
+		return
+	}
+	switch route {
+	case "GET /instances":
+	case "POST /instances":
+		a.Add(instance)
+	case "DELETE /instances":
+		if !a.Remove(instance) {
+			http.Error(w, "unknown instance "+instance, http.StatusNotFound)
+			return
+		}
+	case "POST /instances/drain":
+		if !a.Drain(instance) {
+			http.Error(w, "unknown instance "+instance, http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(a.Instances())
+}
+
+//proxyStats 记录每个实例所有方法的请求数和每个方法的熔断器，实例被重新创建时继续使用原来的计数
+type proxyStats struct {
+	mtx       sync.Mutex
+	instances map[string]*instanceStats
+}
+
+type instanceStats struct {
+	requests int64
+	failures int64
+	inFlight int64
+	breakers map[string]*gobreaker.CircuitBreaker
+}
+
+func newProxyStats() *proxyStats {
+	return &proxyStats{instances: map[string]*instanceStats{}}
+}
+
+// middleware 记录发给 instance 的 method 请求，传输层返回错误时计为失败，s 为 nil 时不做任何事
+func (s *proxyStats) middleware(instance, method string, breaker *gobreaker.CircuitBreaker) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		if s == nil {
+			return next
+		}
+		s.mtx.Lock()
+		st, ok := s.instances[instance]
+		if !ok {
+			st = &instanceStats{breakers: map[string]*gobreaker.CircuitBreaker{}}
+			s.instances[instance] = st
+		}
+		st.breakers[method] = breaker
+		s.mtx.Unlock()
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			atomic.AddInt64(&st.requests, 1)
+			atomic.AddInt64(&st.inFlight, 1)
+			defer atomic.AddInt64(&st.inFlight, -1)
+			response, err := next(ctx, request)
+			if err != nil {
+				atomic.AddInt64(&st.failures, 1)
+			}
+			return response, err
+		}
+	}
+}
+
+// fill 把 status.Instance 的计数和熔断器状态填到 status 中
+func (s *proxyStats) fill(status *instanceStatus) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	st, ok := s.instances[status.Instance]
+	if !ok {
+		return
+	}
+	status.Requests = atomic.LoadInt64(&st.requests)
+	status.Failures = atomic.LoadInt64(&st.failures)
+	status.InFlight = atomic.LoadInt64(&st.inFlight)
+	status.Breakers = map[string]string{}
+	for method, breaker := range st.breakers {
+		status.Breakers[method] = breaker.State().String()
+	}
+}
+
+// retain 删除不在 instances 中的实例的计数
+func (s *proxyStats) retain(instances []string) {
+	if s == nil {
+		return
+	}
+	keep := map[string]bool{}
+	for _, instance := range instances {
+		keep[instance] = true
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for instance := range s.instances {
+		if !keep[instance] {
+			delete(s.instances, instance)
+		}
+	}
+}
+
+// copyEvent 每个订阅者都需要自己的一份实例列表
+func copyEvent(e sd.Event) sd.Event {
+	instances := make([]string, len(e.Instances))
+	copy(instances, e.Instances)
+	e.Instances = instances
+	return e
+}
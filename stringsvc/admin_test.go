@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+)
+
+func TestProxyAdminSlowSubscriber(t *testing.T) {
+	a := newProxyAdmin(nil, nil, log.NewNopLogger())
+	slow := make(chan sd.Event)
+	a.Register(slow)
+	defer a.Deregister(slow)
+
+	// 没有人读取 slow 时修改和查询也不会被阻塞
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.Add("a:8001")
+		a.Add("b:8001")
+		a.Drain("a:8001")
+		a.Instances()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("admin blocked on a subscriber that is not reading")
+	}
+
+	// 订阅者最终收到最新的实例列表
+	want := []string{"b:8001"}
+	for deadline := time.After(time.Second); ; {
+		select {
+		case event := <-slow:
+			if reflect.DeepEqual(want, event.Instances) {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("never received %v", want)
+		}
+	}
+}
+
+func TestProxyAdminDeregisterStopsDelivery(t *testing.T) {
+	a := newProxyAdmin(nil, nil, log.NewNopLogger())
+	for i := 0; i < 100; i++ {
+		ch := make(chan sd.Event)
+		a.Register(ch)
+		go a.Add("a:8001")
+		// 和 sd.Endpointer 一样，注销后马上关闭 channel
+		a.Deregister(ch)
+		close(ch)
+		a.Remove("a:8001")
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/ratelimit"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/sony/gobreaker"
+)
+
+// -lb 可以选择的负载均衡策略
+const (
+	lbRoundRobin         = "round-robin"
+	lbLeastOutstanding   = "least-outstanding"
+	lbWeightedRoundRobin = "weighted-round-robin"
+	lbPeakEWMA           = "peak-ewma"
+	lbConsistentHash     = "consistent-hash"
+)
+
+//lbConfig 负载均衡的配置，Weights 只用于 weighted-round-robin，没有出现的实例权重为 1
+type lbConfig struct {
+	Strategy string
+	Weights  map[string]int
+}
+
+//parseLBConfig 解析 -lb 和 -lb-weights，weights 的格式是 host:port=3,host:port=1
+func parseLBConfig(strategy, weights string) (lbConfig, error) {
+	switch strategy {
+	case lbRoundRobin, lbLeastOutstanding, lbWeightedRoundRobin, lbPeakEWMA, lbConsistentHash:
+	default:
+		return lbConfig{}, fmt.Errorf("unknown load balancer %q", strategy)
+	}
+	c := lbConfig{Strategy: strategy, Weights: map[string]int{}}
+	for _, pair := range split(weights) {
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return lbConfig{}, fmt.Errorf("invalid weight %q, want instance=weight", pair)
+		}
+		w, err := strconv.Atoi(pair[i+1:])
+		if err != nil || w <= 0 {
+			return lbConfig{}, fmt.Errorf("invalid weight %q, want a positive integer", pair)
+		}
+		c.Weights[pair[:i]] = w
+	}
+	return c, nil
+}
+
+//newBalancer round-robin 直接使用 endpointer，其他策略需要知道每个实例的状态，从 ups 中选择
+func newBalancer(c lbConfig, endpointer sd.Endpointer, ups *upstreams) lb.Balancer {
+	switch c.Strategy {
+	case lbLeastOutstanding:
+		return &leastOutstanding{ups: ups}
+	case lbWeightedRoundRobin:
+		return &weightedRoundRobin{ups: ups, weights: c.Weights, current: map[string]int{}}
+	case lbPeakEWMA:
+		return &peakEWMA{ups: ups, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	case lbConsistentHash:
+		return &consistentHash{ups: ups, key: requestKey}
+	default:
+		return lb.NewRoundRobin(endpointer)
+	}
+}
+
+//upstreams 当前可用的实例，endpointer 的 factory 创建实例时添加，实例下线时通过 factory 返回的 io.Closer 删除
+//go-kit 的 endpoint 是函数，没有办法作为 map 的 key，所以实例的状态保存在这里
+type upstreams struct {
+	mtx     sync.RWMutex
+	list    []*upstream
+	version uint64
+}
+
+//upstream 一个实例，记录正在进行中的请求数和延迟
+type upstream struct {
+	instance    string
+	e           endpoint.Endpoint
+	outstanding int64
+	// rejected 最近一次被熔断器或者频率限制拒绝的时间，UnixNano
+	rejected int64
+
+	mtx   sync.Mutex
+	ewma  float64 // 纳秒
+	stamp time.Time
+}
+
+const (
+	// ewmaDecay peak-EWMA 中延迟的衰减时间，越大越平滑
+	ewmaDecay = 10 * time.Second
+	// penalty 被拒绝的请求按这个延迟计算，并且这段时间内 least-outstanding 尽量不选择这个实例
+	// 还没有延迟数据的新实例在有请求进行中时也按这个延迟计算
+	penalty = time.Second
+)
+
+func (u *upstreams) add(instance string, e endpoint.Endpoint) io.Closer {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	// 复制一份再修改，snapshot 返回的切片可能正在被使用
+	list := make([]*upstream, 0, len(u.list)+1)
+	list = append(list, u.list...)
+	list = append(list, &upstream{instance: instance, e: e, stamp: time.Now()})
+	sort.Slice(list, func(i, j int) bool { return list[i].instance < list[j].instance })
+	u.list = list
+	u.version++
+	return upstreamCloser{u, instance}
+}
+
+func (u *upstreams) remove(instance string) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	for i, up := range u.list {
+		if up.instance == instance {
+			u.list = append(u.list[:i:i], u.list[i+1:]...)
+			u.version++
+			return
+		}
+	}
+}
+
+// snapshot 返回的切片不会被修改，版本号变化说明实例列表变了
+func (u *upstreams) snapshot() ([]*upstream, uint64) {
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+	return u.list, u.version
+}
+
+type upstreamCloser struct {
+	ups      *upstreams
+	instance string
+}
+
+func (c upstreamCloser) Close() error {
+	c.ups.remove(c.instance)
+	return nil
+}
+
+// call 记录正在进行中的请求数和延迟，熔断器和频率限制拒绝的请求会立即返回，
+// 使用真实的延迟会让不可用的实例看起来最快，所以按 penalty 计算
+func (up *upstream) call(ctx context.Context, request interface{}) (interface{}, error) {
+	atomic.AddInt64(&up.outstanding, 1)
+	defer atomic.AddInt64(&up.outstanding, -1)
+	begin := time.Now()
+	response, err := up.e(ctx, request)
+	now := time.Now()
+	rtt := now.Sub(begin)
+	if rejected(err) {
+		atomic.StoreInt64(&up.rejected, now.UnixNano())
+		rtt = penalty
+	}
+	up.observe(rtt, now)
+	return response, err
+}
+
+// rejected 请求是否被熔断器或者频率限制拒绝，没有发给实例
+func rejected(err error) bool {
+	return errors.Is(err, gobreaker.ErrOpenState) ||
+		errors.Is(err, gobreaker.ErrTooManyRequests) ||
+		errors.Is(err, ratelimit.ErrLimited)
+}
+
+// penalized 实例最近 penalty 时间内是否拒绝过请求
+func (up *upstream) penalized(now time.Time) bool {
+	return now.UnixNano()-atomic.LoadInt64(&up.rejected) < int64(penalty)
+}
+
+// observe 延迟超过当前值时直接跳到峰值，否则按照经过的时间指数衰减
+func (up *upstream) observe(rtt time.Duration, now time.Time) {
+	up.mtx.Lock()
+	defer up.mtx.Unlock()
+	v := float64(rtt)
+	if v > up.ewma {
+		up.ewma = v
+	} else {
+		w := math.Exp(-float64(now.Sub(up.stamp)) / float64(ewmaDecay))
+		up.ewma = up.ewma*w + v*(1-w)
+	}
+	up.stamp = now
+}
+
+// cost peak-EWMA 的代价，延迟乘以正在进行中的请求数
+// 还没有延迟数据的新实例只有在没有进行中的请求时代价为 0，先发一个请求试探，避免刚加入就接收所有请求
+func (up *upstream) cost() float64 {
+	up.mtx.Lock()
+	ewma := up.ewma
+	up.mtx.Unlock()
+	outstanding := atomic.LoadInt64(&up.outstanding)
+	if ewma == 0 && outstanding > 0 {
+		return float64(penalty) + float64(outstanding)
+	}
+	return ewma * float64(outstanding+1)
+}
+
+//leastOutstanding 选择正在进行中的请求最少的实例，最近拒绝过请求的实例排在后面
+//请求数相同时从上一次选择的下一个开始，避免总是选择第一个
+type leastOutstanding struct {
+	ups  *upstreams
+	next uint64
+}
+
+//Endpoint 实现 lb.Balancer
+func (b *leastOutstanding) Endpoint() (endpoint.Endpoint, error) {
+	list, _ := b.ups.snapshot()
+	if len(list) == 0 {
+		return nil, lb.ErrNoEndpoints
+	}
+	now := time.Now()
+	start := int(atomic.AddUint64(&b.next, 1) % uint64(len(list)))
+	best, bestPenalized := list[start], list[start].penalized(now)
+	for i := 1; i < len(list); i++ {
+		up := list[(start+i)%len(list)]
+		penalized := up.penalized(now)
+		if penalized != bestPenalized {
+			if !penalized {
+				best, bestPenalized = up, penalized
+			}
+			continue
+		}
+		if atomic.LoadInt64(&up.outstanding) < atomic.LoadInt64(&best.outstanding) {
+			best = up
+		}
+	}
+	return best.call, nil
+}
+
+//weightedRoundRobin 平滑的加权轮询，权重为 3 和 1 的两个实例的顺序是 a a b a，而不是 a a a b
+type weightedRoundRobin struct {
+	ups     *upstreams
+	weights map[string]int
+
+	mtx     sync.Mutex
+	current map[string]int
+}
+
+//Endpoint 实现 lb.Balancer
+func (b *weightedRoundRobin) Endpoint() (endpoint.Endpoint, error) {
+	list, _ := b.ups.snapshot()
+	if len(list) == 0 {
+		return nil, lb.ErrNoEndpoints
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	var (
+		best  *upstream
+		total int
+		live  = map[string]bool{}
+	)
+	for _, up := range list {
+		w := b.weight(up.instance)
+		total += w
+		b.current[up.instance] += w
+		live[up.instance] = true
+		if best == nil || b.current[up.instance] > b.current[best.instance] {
+			best = up
+		}
+	}
+	b.current[best.instance] -= total
+	for instance := range b.current {
+		if !live[instance] {
+			delete(b.current, instance)
+		}
+	}
+	return best.call, nil
+}
+
+func (b *weightedRoundRobin) weight(instance string) int {
+	if w, ok := b.weights[instance]; ok {
+		return w
+	}
+	return 1
+}
+
+//peakEWMA 随机选择两个实例，使用延迟乘以进行中请求数较小的一个，慢的实例会自动少分到请求
+type peakEWMA struct {
+	ups *upstreams
+
+	mtx  sync.Mutex
+	rand *rand.Rand
+}
+
+//Endpoint 实现 lb.Balancer
+func (b *peakEWMA) Endpoint() (endpoint.Endpoint, error) {
+	list, _ := b.ups.snapshot()
+	switch len(list) {
+	case 0:
+		return nil, lb.ErrNoEndpoints
+	case 1:
+		return list[0].call, nil
+	}
+	b.mtx.Lock()
+	i := b.rand.Intn(len(list))
+	j := b.rand.Intn(len(list) - 1)
+	b.mtx.Unlock()
+	if j >= i {
+		j++
+	}
+	if list[j].cost() < list[i].cost() {
+		i = j
+	}
+	return list[i].call, nil
+}
+
+// virtualNodes 一致性哈希中每个实例在环上的节点数，越多分布越均匀
+const virtualNodes = 100
+
+//consistentHash 根据 key(request) 在哈希环上选择实例，同样的输入总是发到同一个实例
+//实例增加或减少时只有一小部分 key 会换到别的实例，重试时仍然会选择同一个实例
+type consistentHash struct {
+	ups *upstreams
+	key func(request interface{}) string
+
+	mtx     sync.Mutex
+	version uint64
+	ring    []ringNode
+}
+
+type ringNode struct {
+	hash uint32
+	up   *upstream
+}
+
+//Endpoint 实现 lb.Balancer，返回的 endpoint 在调用时才根据请求选择实例
+func (b *consistentHash) Endpoint() (endpoint.Endpoint, error) {
+	ring := b.currentRing()
+	if len(ring) == 0 {
+		return nil, lb.ErrNoEndpoints
+	}
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return lookup(ring, hashKey(b.key(request))).call(ctx, request)
+	}, nil
+}
+
+// lookup 返回环上哈希值不小于 h 的第一个节点，超过最后一个节点时回到第一个
+func lookup(ring []ringNode, h uint32) *upstream {
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].up
+}
+
+// currentRing 实例列表变化后重新生成哈希环
+func (b *consistentHash) currentRing() []ringNode {
+	list, version := b.ups.snapshot()
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.ring != nil && version == b.version {
+		return b.ring
+	}
+	ring := make([]ringNode, 0, len(list)*virtualNodes)
+	for _, up := range list {
+		for i := 0; i < virtualNodes; i++ {
+			ring = append(ring, ringNode{hashKey(up.instance + "#" + strconv.Itoa(i)), up})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	b.ring, b.version = ring, version
+	return ring
+}
+
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// requestKey 一致性哈希使用的 key，所有方法都使用输入的字符串
+func requestKey(request interface{}) string {
+	switch r := request.(type) {
+	case uppercaseRequest:
+		return r.S
+	case countRequest:
+		return r.S
+	}
+	return ""
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/ratelimit"
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/sony/gobreaker"
+)
+
+// newTestUpstreams 每个实例的 endpoint 返回实例的名字
+func newTestUpstreams(instances ...string) *upstreams {
+	ups := &upstreams{}
+	for _, instance := range instances {
+		ups.add(instance, nameEndpoint(instance))
+	}
+	return ups
+}
+
+func nameEndpoint(instance string) endpoint.Endpoint {
+	return func(context.Context, interface{}) (interface{}, error) { return instance, nil }
+}
+
+func find(ups *upstreams, instance string) *upstream {
+	list, _ := ups.snapshot()
+	for _, up := range list {
+		if up.instance == instance {
+			return up
+		}
+	}
+	return nil
+}
+
+// pick 从 b 中选择 n 次，返回选中的实例
+func pick(t *testing.T, b lb.Balancer, request interface{}, n int) []string {
+	t.Helper()
+	var picked []string
+	for i := 0; i < n; i++ {
+		e, err := b.Endpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := e(context.Background(), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked = append(picked, response.(string))
+	}
+	return picked
+}
+
+func TestBalancersNoEndpoints(t *testing.T) {
+	ups := &upstreams{}
+	for _, b := range []lb.Balancer{
+		&leastOutstanding{ups: ups},
+		&weightedRoundRobin{ups: ups, current: map[string]int{}},
+		&peakEWMA{ups: ups},
+		&consistentHash{ups: ups, key: requestKey},
+	} {
+		if _, err := b.Endpoint(); err != lb.ErrNoEndpoints {
+			t.Errorf("%T: want %v, have %v", b, lb.ErrNoEndpoints, err)
+		}
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	for _, tc := range []struct {
+		weights map[string]int
+		want    string
+	}{
+		{map[string]int{"a": 3}, "a a b a a a b a"},
+		{map[string]int{"b": 3}, "b a b b b a b b"},
+		{map[string]int{}, "a b a b"},
+		{map[string]int{"a": 5, "b": 1}, "a a a b a a a a a b a a"},
+	} {
+		ups := newTestUpstreams("a", "b")
+		b := &weightedRoundRobin{ups: ups, weights: tc.weights, current: map[string]int{}}
+		n := len(strings.Fields(tc.want))
+		if have := strings.Join(pick(t, b, nil, n), " "); have != tc.want {
+			t.Errorf("weights %v: want %q, have %q", tc.weights, tc.want, have)
+		}
+	}
+}
+
+func TestWeightedRoundRobinRemove(t *testing.T) {
+	ups := newTestUpstreams("a", "b", "c")
+	b := &weightedRoundRobin{ups: ups, weights: map[string]int{"c": 2}, current: map[string]int{}}
+	pick(t, b, nil, 3)
+	ups.remove("c")
+	if have := strings.Join(pick(t, b, nil, 4), " "); have != "a b a b" && have != "b a b a" {
+		t.Errorf("want a and b to alternate, have %q", have)
+	}
+	if _, ok := b.current["c"]; ok {
+		t.Error("removed instance still has weight state")
+	}
+}
+
+func TestLeastOutstandingTieBreak(t *testing.T) {
+	ups := newTestUpstreams("a", "b", "c")
+	b := &leastOutstanding{ups: ups}
+	if want, have := "b c a b c a", strings.Join(pick(t, b, nil, 6), " "); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	ups := newTestUpstreams("a", "b", "c")
+	find(ups, "a").outstanding = 2
+	find(ups, "b").outstanding = 1
+	find(ups, "c").outstanding = 3
+	b := &leastOutstanding{ups: ups}
+	for _, have := range pick(t, b, nil, 3) {
+		if have != "b" {
+			t.Fatalf("want b, have %s", have)
+		}
+	}
+
+	// 最近拒绝过请求的实例即使没有进行中的请求也排在后面
+	find(ups, "b").outstanding = 0
+	find(ups, "b").rejected = time.Now().UnixNano()
+	for _, have := range pick(t, b, nil, 3) {
+		if have != "a" {
+			t.Fatalf("want a, have %s", have)
+		}
+	}
+}
+
+func TestPeakEWMADecay(t *testing.T) {
+	begin := time.Now()
+	up := &upstream{stamp: begin}
+
+	// 延迟变大时直接跳到峰值
+	up.observe(100*time.Millisecond, begin)
+	if want, have := float64(100*time.Millisecond), up.ewma; want != have {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+
+	// 延迟变小时按经过的时间衰减，经过 ewmaDecay 后旧值的权重是 1/e
+	up.observe(10*time.Millisecond, begin.Add(ewmaDecay))
+	w := math.Exp(-1)
+	want := float64(100*time.Millisecond)*w + float64(10*time.Millisecond)*(1-w)
+	if math.Abs(up.ewma-want) > 1 {
+		t.Fatalf("want %v, have %v", want, up.ewma)
+	}
+
+	// 很久之后旧值几乎没有影响
+	up.observe(10*time.Millisecond, begin.Add(100*ewmaDecay))
+	if math.Abs(up.ewma-float64(10*time.Millisecond)) > float64(time.Microsecond) {
+		t.Fatalf("want about %v, have %v", 10*time.Millisecond, time.Duration(up.ewma))
+	}
+
+	up.observe(500*time.Millisecond, begin.Add(101*ewmaDecay))
+	if want, have := float64(500*time.Millisecond), up.ewma; want != have {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+}
+
+func TestPeakEWMAPrefersFaster(t *testing.T) {
+	ups := newTestUpstreams("fast", "slow")
+	find(ups, "fast").ewma = float64(10 * time.Millisecond)
+	find(ups, "slow").ewma = float64(100 * time.Millisecond)
+	b := newBalancer(lbConfig{Strategy: lbPeakEWMA}, nil, ups)
+	for _, have := range pick(t, b, nil, 10) {
+		if have != "fast" {
+			t.Fatalf("want fast, have %s", have)
+		}
+	}
+
+	// 进行中的请求多了之后慢的实例代价更小
+	find(ups, "fast").outstanding = 20
+	for _, have := range pick(t, b, nil, 10) {
+		if have != "slow" {
+			t.Fatalf("want slow, have %s", have)
+		}
+	}
+}
+
+func TestNewUpstreamCost(t *testing.T) {
+	up := &upstream{stamp: time.Now()}
+	if have := up.cost(); have != 0 {
+		t.Errorf("idle new upstream: want 0, have %v", have)
+	}
+	up.outstanding = 1
+	if want, have := float64(penalty)+1, up.cost(); want != have {
+		t.Errorf("busy new upstream: want %v, have %v", want, have)
+	}
+}
+
+func TestRejectionPenalty(t *testing.T) {
+	for _, err := range []error{gobreaker.ErrOpenState, gobreaker.ErrTooManyRequests, ratelimit.ErrLimited} {
+		up := &upstream{
+			e:     func(context.Context, interface{}) (interface{}, error) { return nil, err },
+			stamp: time.Now(),
+			ewma:  float64(time.Millisecond),
+		}
+		up.call(context.Background(), nil)
+		if want, have := float64(penalty), up.ewma; want != have {
+			t.Errorf("%v: want ewma %v, have %v", err, want, have)
+		}
+		if !up.penalized(time.Now()) {
+			t.Errorf("%v: want penalized", err)
+		}
+		if up.penalized(time.Now().Add(penalty)) {
+			t.Errorf("%v: want penalty to expire", err)
+		}
+	}
+}
+
+func TestRingLookup(t *testing.T) {
+	a, b := &upstream{instance: "a"}, &upstream{instance: "b"}
+	ring := []ringNode{{10, a}, {20, b}}
+	for _, tc := range []struct {
+		hash uint32
+		want *upstream
+	}{
+		{0, a},
+		{10, a},
+		{11, b},
+		{20, b},
+		{21, a}, // 超过最后一个节点后回到第一个
+		{math.MaxUint32, a},
+	} {
+		if have := lookup(ring, tc.hash); have != tc.want {
+			t.Errorf("hash %d: want %s, have %s", tc.hash, tc.want.instance, have.instance)
+		}
+	}
+}
+
+func TestConsistentHashStability(t *testing.T) {
+	ups := newTestUpstreams("a", "b", "c")
+	b := &consistentHash{ups: ups, key: requestKey}
+	route := func() map[string]string {
+		m := map[string]string{}
+		for i := 0; i < 1000; i++ {
+			key := "key" + strconv.Itoa(i)
+			m[key] = pick(t, b, uppercaseRequest{S: key}, 1)[0]
+		}
+		return m
+	}
+	before := route()
+	if again := route(); len(diff(before, again)) != 0 {
+		t.Fatalf("same keys routed differently: %v", diff(before, again))
+	}
+
+	// 增加实例后只有换到新实例的 key 会变化
+	ups.add("d", nameEndpoint("d"))
+	added := route()
+	for key := range diff(before, added) {
+		if added[key] != "d" {
+			t.Errorf("%s moved from %s to %s, want d", key, before[key], added[key])
+		}
+	}
+	if moved := len(diff(before, added)); moved == 0 || moved > 500 {
+		t.Errorf("want about a quarter of the keys to move to d, have %d", moved)
+	}
+
+	// 删除实例后只有原来在这个实例上的 key 会变化
+	ups.remove("b")
+	removed := route()
+	for key := range diff(added, removed) {
+		if added[key] != "b" {
+			t.Errorf("%s moved from %s to %s, want only keys from b to move", key, added[key], removed[key])
+		}
+	}
+}
+
+func diff(a, b map[string]string) map[string]bool {
+	d := map[string]bool{}
+	for k, v := range a {
+		if b[k] != v {
+			d[k] = true
+		}
+	}
+	return d
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-kit/kit/circuitbreaker"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/sony/gobreaker"
+)
+
+//breakerConfig 熔断器的配置，值为 0 的项使用 gobreaker 的默认值
+type breakerConfig struct {
+	// Failures 连续失败多少次后打开熔断器
+	Failures uint32
+	// FailureRatio 和 MinRequests 一起使用，Interval 内请求数达到 MinRequests 并且失败率达到 FailureRatio 时打开熔断器
+	FailureRatio float64
+	MinRequests  uint32
+	// Interval 关闭状态下清零计数的周期，0 表示不清零
+	Interval time.Duration
+	// Timeout 打开状态持续多久后进入半开状态
+	Timeout time.Duration
+	// HalfOpenRequests 半开状态下允许通过的请求数
+	HalfOpenRequests uint32
+}
+
+func (c breakerConfig) readyToTrip(counts gobreaker.Counts) bool {
+	if c.Failures > 0 && counts.ConsecutiveFailures >= c.Failures {
+		return true
+	}
+	return c.FailureRatio > 0 && counts.Requests >= c.MinRequests &&
+		float64(counts.TotalFailures)/float64(counts.Requests) >= c.FailureRatio
+}
+
+//breakers 创建并记录每个实例每个方法的熔断器，状态变化时记录日志并更新 gauge，ServeHTTP 是管理接口上的 /debug/breakers 页面
+type breakers struct {
+	config breakerConfig
+	state  *stdprometheus.GaugeVec
+	logger log.Logger
+
+	mtx  sync.Mutex
+	list map[string]*breaker
+}
+
+// breaker 除了 gobreaker 的状态，还记录从创建开始的累计计数，gobreaker 的计数每次状态变化都会清零
+type breaker struct {
+	cb          *gobreaker.CircuitBreaker
+	instance    string
+	method      string
+	requests    int64
+	failures    int64
+	rejected    int64
+	transitions int64
+	changed     atomic.Value // time.Time
+	// closed 实例已经下线，之后的状态变化不再更新 gauge
+	closed int32
+}
+
+//newBreakers state 是熔断器状态的 gauge，标签是 instance 和 method，0 关闭，1 半开，2 打开，实例下线时删除
+func newBreakers(config breakerConfig, state *stdprometheus.GaugeVec, logger log.Logger) (*breakers, error) {
+	if config.FailureRatio < 0 || config.FailureRatio > 1 {
+		return nil, fmt.Errorf("breaker failure ratio must be between 0 and 1, got %v", config.FailureRatio)
+	}
+	return &breakers{
+		config: config,
+		state:  state,
+		logger: logger,
+		list:   map[string]*breaker{},
+	}, nil
+}
+
+//New 为 instance 的 method 创建熔断器，返回的 io.Closer 在实例下线时调用
+func (b *breakers) New(instance, method string) (*gobreaker.CircuitBreaker, endpoint.Middleware, io.Closer) {
+	name := instance + "/" + method
+	state := b.state.WithLabelValues(instance, method)
+	br := &breaker{instance: instance, method: method}
+	br.changed.Store(time.Now())
+	settings := gobreaker.Settings{
+		Name:        name,
+		MaxRequests: b.config.HalfOpenRequests,
+		Interval:    b.config.Interval,
+		Timeout:     b.config.Timeout,
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			b.logger.Log("breaker", name, "from", from, "to", to)
+			if atomic.LoadInt32(&br.closed) == 0 {
+				state.Set(float64(to))
+			}
+			atomic.AddInt64(&br.transitions, 1)
+			br.changed.Store(time.Now())
+		},
+	}
+	if b.config.Failures > 0 || b.config.FailureRatio > 0 {
+		settings.ReadyToTrip = b.config.readyToTrip
+	}
+	br.cb = gobreaker.NewCircuitBreaker(settings)
+	state.Set(float64(gobreaker.StateClosed))
+
+	b.mtx.Lock()
+	b.list[name] = br
+	b.mtx.Unlock()
+	return br.cb, br.middleware, breakerCloser{b, br}
+}
+
+// middleware 在 gobreaker 的外面统计请求，被熔断器拒绝的请求单独计数
+func (br *breaker) middleware(next endpoint.Endpoint) endpoint.Endpoint {
+	next = circuitbreaker.Gobreaker(br.cb)(next)
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		atomic.AddInt64(&br.requests, 1)
+		response, err := next(ctx, request)
+		switch {
+		case errors.Is(err, gobreaker.ErrOpenState), errors.Is(err, gobreaker.ErrTooManyRequests):
+			atomic.AddInt64(&br.rejected, 1)
+		case err != nil:
+			atomic.AddInt64(&br.failures, 1)
+		}
+		return response, err
+	}
+}
+
+type breakerCloser struct {
+	breakers *breakers
+	br       *breaker
+}
+
+// Close 同一个实例可能已经重新上线，只删除自己的熔断器
+func (c breakerCloser) Close() error {
+	c.breakers.mtx.Lock()
+	defer c.breakers.mtx.Unlock()
+	atomic.StoreInt32(&c.br.closed, 1)
+	name := c.br.instance + "/" + c.br.method
+	if c.breakers.list[name] != c.br {
+		return nil
+	}
+	delete(c.breakers.list, name)
+	c.breakers.state.DeleteLabelValues(c.br.instance, c.br.method)
+	return nil
+}
+
+//ServeHTTP 以表格的形式列出所有熔断器的当前状态和累计计数
+func (b *breakers) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	b.mtx.Lock()
+	list := make([]*breaker, 0, len(b.list))
+	for _, br := range b.list {
+		list = append(list, br)
+	}
+	b.mtx.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].instance != list[j].instance {
+			return list[i].instance < list[j].instance
+		}
+		return list[i].method < list[j].method
+	})
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 2, 2, ' ', 0)
+	fmt.Fprintf(tw, "INSTANCE\tMETHOD\tSTATE\tSINCE\tREQUESTS\tFAILURES\tREJECTED\tTRANSITIONS\n")
+	for _, br := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\n",
+			br.instance,
+			br.method,
+			br.cb.State(),
+			time.Since(br.changed.Load().(time.Time)).Round(time.Second),
+			atomic.LoadInt64(&br.requests),
+			atomic.LoadInt64(&br.failures),
+			atomic.LoadInt64(&br.rejected),
+			atomic.LoadInt64(&br.transitions),
+		)
+	}
+	tw.Flush()
+}
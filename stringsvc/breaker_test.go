@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sony/gobreaker"
+)
+
+func newBreakerStateVec() *stdprometheus.GaugeVec {
+	return stdprometheus.NewGaugeVec(stdprometheus.GaugeOpts{Name: "circuit_breaker_state"}, []string{"instance", "method"})
+}
+
+func TestBreakerCloseDeletesState(t *testing.T) {
+	state := newBreakerStateVec()
+	b, err := newBreakers(breakerConfig{Failures: 1}, state, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, middleware, closer := b.New("a:8080", "uppercase")
+	failing := middleware(func(context.Context, interface{}) (interface{}, error) { return nil, errors.New("down") })
+	failing(context.Background(), nil)
+	if cb.State() != gobreaker.StateOpen {
+		t.Fatalf("want open breaker, have %s", cb.State())
+	}
+	if want, have := float64(gobreaker.StateOpen), testutil.ToFloat64(state.WithLabelValues("a:8080", "uppercase")); want != have {
+		t.Errorf("want state %v, have %v", want, have)
+	}
+
+	closer.Close()
+	if have := series(state); have != 0 {
+		t.Errorf("want no series after close, have %d", have)
+	}
+}
+
+func TestBreakerCloseKeepsReplacement(t *testing.T) {
+	state := newBreakerStateVec()
+	b, err := newBreakers(breakerConfig{}, state, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, old := b.New("a:8080", "uppercase")
+	b.New("a:8080", "uppercase")
+	// 实例重新上线后旧的熔断器才被关闭，不能删除新的熔断器和它的 gauge
+	old.Close()
+	if have := series(state); have != 1 {
+		t.Errorf("want the replacement's series, have %d", have)
+	}
+	if have := len(b.list); have != 1 {
+		t.Errorf("want the replacement breaker, have %d", have)
+	}
+}
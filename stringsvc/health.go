@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+//healthConfig 主动健康检查的配置，Fall 次连续失败后摘除实例，Rise 次连续成功后恢复
+type healthConfig struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Rise     int
+	Fall     int
+}
+
+//healthChecker 定期请求每个实例的 /healthz，实现了 sd.Instancer，只把健康的实例发给订阅者
+//新发现的实例先认为是健康的，并且立即检查一次，同一个实例同时只会有一次检查
+//所有实例都不健康时把全部实例发给订阅者，比如滚动升级时老版本的实例还没有 /healthz，不至于全部被摘除
+type healthChecker struct {
+	source  sd.Instancer
+	events  chan sd.Event
+	config  healthConfig
+	client  *http.Client
+	healthy *stdprometheus.GaugeVec
+	checks  *stdprometheus.CounterVec
+	logger  log.Logger
+	quit    chan struct{}
+
+	mtx       sync.Mutex
+	instances map[string]*instanceHealth
+	failOpen  bool
+	state     sd.Event
+	registry  map[chan<- sd.Event]struct{}
+}
+
+type instanceHealth struct {
+	healthy   bool
+	successes int
+	failures  int
+	// checking 正在检查中，定期检查和新实例的检查不会同时进行，结果不会被重复计数
+	checking bool
+}
+
+//newHealthChecker healthy 是每个实例是否健康的 gauge，标签是 instance，checks 是检查结果的计数，标签是 instance 和 result
+//实例下线时删除它的 healthy 和 checks，不会一直保留已经不存在的实例
+func newHealthChecker(source sd.Instancer, config healthConfig, healthy *stdprometheus.GaugeVec, checks *stdprometheus.CounterVec, logger log.Logger) (*healthChecker, error) {
+	if config.Interval <= 0 || config.Timeout <= 0 || config.Rise <= 0 || config.Fall <= 0 {
+		return nil, fmt.Errorf("invalid health check config %+v", config)
+	}
+	h := &healthChecker{
+		source:    source,
+		events:    make(chan sd.Event),
+		config:    config,
+		client:    &http.Client{Timeout: config.Timeout},
+		healthy:   healthy,
+		checks:    checks,
+		logger:    log.With(logger, "health", "check"),
+		quit:      make(chan struct{}),
+		instances: map[string]*instanceHealth{},
+		state:     sd.Event{Instances: []string{}},
+		registry:  map[chan<- sd.Event]struct{}{},
+	}
+	go func() {
+		for event := range h.events {
+			h.setSource(event)
+		}
+	}()
+	source.Register(h.events)
+	go h.loop()
+	return h, nil
+}
+
+func (h *healthChecker) loop() {
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.checkAll(h.known())
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+// setSource 服务发现出错时继续使用上一次的实例列表
+func (h *healthChecker) setSource(event sd.Event) {
+	if event.Err != nil {
+		h.logger.Log("err", event.Err)
+		return
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	current := map[string]bool{}
+	var added []string
+	for _, instance := range event.Instances {
+		current[instance] = true
+		if _, ok := h.instances[instance]; !ok {
+			h.instances[instance] = &instanceHealth{healthy: true}
+			h.healthy.WithLabelValues(instance).Set(1)
+			added = append(added, instance)
+		}
+	}
+	for instance := range h.instances {
+		if !current[instance] {
+			delete(h.instances, instance)
+			h.healthy.DeleteLabelValues(instance)
+			h.checks.DeleteLabelValues(instance, "success")
+			h.checks.DeleteLabelValues(instance, "failure")
+		}
+	}
+	h.publish()
+	if len(added) > 0 {
+		go h.checkAll(added)
+	}
+}
+
+func (h *healthChecker) known() []string {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	var instances []string
+	for instance := range h.instances {
+		instances = append(instances, instance)
+	}
+	return instances
+}
+
+// checkAll 并发检查所有实例，跳过正在检查中的实例，全部完成后一起更新状态
+func (h *healthChecker) checkAll(instances []string) {
+	h.mtx.Lock()
+	var pending []*instanceHealth
+	var names []string
+	for _, instance := range instances {
+		if ih, ok := h.instances[instance]; ok && !ih.checking {
+			ih.checking = true
+			pending = append(pending, ih)
+			names = append(names, instance)
+		}
+	}
+	h.mtx.Unlock()
+
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, instance := range names {
+		wg.Add(1)
+		go func(i int, instance string) {
+			defer wg.Done()
+			errs[i] = h.check(instance)
+		}(i, instance)
+	}
+	wg.Wait()
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for i, instance := range names {
+		pending[i].checking = false
+		// 检查期间实例已经下线，或者下线后又重新上线
+		if h.instances[instance] == pending[i] {
+			h.record(instance, pending[i], errs[i])
+		}
+	}
+	h.publish()
+}
+
+// check 返回 nil 表示 /healthz 返回了 200
+func (h *healthChecker) check(instance string) error {
+	u, err := instanceURL(instance, "/healthz")
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// record 必须在持有锁时调用，状态变化时记录日志
+func (h *healthChecker) record(instance string, ih *instanceHealth, err error) {
+	if err != nil {
+		h.checks.WithLabelValues(instance, "failure").Inc()
+		ih.successes, ih.failures = 0, ih.failures+1
+		if ih.healthy && ih.failures >= h.config.Fall {
+			ih.healthy = false
+			h.healthy.WithLabelValues(instance).Set(0)
+			h.logger.Log("instance", instance, "state", "unhealthy", "failures", ih.failures, "err", err)
+		}
+		return
+	}
+	h.checks.WithLabelValues(instance, "success").Inc()
+	ih.successes, ih.failures = ih.successes+1, 0
+	if !ih.healthy && ih.successes >= h.config.Rise {
+		ih.healthy = true
+		h.healthy.WithLabelValues(instance).Set(1)
+		h.logger.Log("instance", instance, "state", "healthy", "successes", ih.successes)
+	}
+}
+
+// publish 必须在持有锁时调用，健康的实例列表没有变化时不通知订阅者
+func (h *healthChecker) publish() {
+	instances := []string{}
+	for instance, ih := range h.instances {
+		if ih.healthy {
+			instances = append(instances, instance)
+		}
+	}
+	failOpen := len(instances) == 0 && len(h.instances) > 0
+	if failOpen {
+		for instance := range h.instances {
+			instances = append(instances, instance)
+		}
+	}
+	if failOpen != h.failOpen {
+		h.failOpen = failOpen
+		h.logger.Log("fail_open", failOpen, "instances", len(h.instances))
+	}
+	sort.Strings(instances)
+	event := sd.Event{Instances: instances}
+	if reflect.DeepEqual(h.state, event) {
+		return
+	}
+	h.state = event
+	for ch := range h.registry {
+		ch <- copyEvent(event)
+	}
+}
+
+//Health 返回实例的健康状态，不认识的实例返回空字符串
+func (h *healthChecker) Health(instance string) string {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	ih, ok := h.instances[instance]
+	switch {
+	case !ok:
+		return ""
+	case ih.healthy:
+		return "healthy"
+	default:
+		return "unhealthy"
+	}
+}
+
+//Register 实现 sd.Instancer
+func (h *healthChecker) Register(ch chan<- sd.Event) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.registry[ch] = struct{}{}
+	ch <- copyEvent(h.state)
+}
+
+//Deregister 实现 sd.Instancer
+func (h *healthChecker) Deregister(ch chan<- sd.Event) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	delete(h.registry, ch)
+}
+
+//Stop 实现 sd.Instancer，停止检查并且不再接收服务发现的更新
+func (h *healthChecker) Stop() {
+	close(h.quit)
+	h.source.Deregister(h.events)
+	close(h.events)
+}
+
+//healthHandler 实例自身的健康检查，进程能处理 HTTP 请求就认为是健康的
+func healthHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
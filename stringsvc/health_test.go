@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+func newHealthyVec() *stdprometheus.GaugeVec {
+	return stdprometheus.NewGaugeVec(stdprometheus.GaugeOpts{Name: "upstream_healthy"}, []string{"instance"})
+}
+
+func newHealthChecksVec() *stdprometheus.CounterVec {
+	return stdprometheus.NewCounterVec(stdprometheus.CounterOpts{Name: "upstream_health_checks"}, []string{"instance", "result"})
+}
+
+// series 返回 c 中 series 的数量
+func series(c stdprometheus.Collector) int {
+	ch := make(chan stdprometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	return len(ch)
+}
+
+// newHealthzServer /healthz 在 healthy 为 1 时返回 200，否则返回 404，和没有 /healthz 的老版本一样
+func newHealthzServer(healthy *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(healthy) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		healthHandler(w, r)
+	}))
+}
+
+func TestHealthCheckerFailOpen(t *testing.T) {
+	var aHealthy, bHealthy int32
+	a, b := newHealthzServer(&aHealthy), newHealthzServer(&bHealthy)
+	defer a.Close()
+	defer b.Close()
+	instances := []string{strings.TrimPrefix(a.URL, "http://"), strings.TrimPrefix(b.URL, "http://")}
+	sort.Strings(instances)
+
+	h, err := newHealthChecker(sd.FixedInstancer(instances), healthConfig{
+		Interval: time.Hour,
+		Timeout:  time.Second,
+		Rise:     1,
+		Fall:     1,
+	}, newHealthyVec(), newHealthChecksVec(), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	state := func() []string {
+		h.mtx.Lock()
+		defer h.mtx.Unlock()
+		return h.state.Instances
+	}
+	// 新实例的检查和定期检查同时进行，同一个实例只会被计数一次
+	for deadline := time.Now().Add(2 * time.Second); h.Health(instances[0]) != "unhealthy" || h.Health(instances[1]) != "unhealthy"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("instances never became unhealthy")
+		}
+		h.checkAll(h.known())
+	}
+	if want, have := instances, state(); !reflect.DeepEqual(want, have) {
+		t.Errorf("all unhealthy: want %v, have %v", want, have)
+	}
+
+	healthy := instances[0]
+	if healthy != strings.TrimPrefix(a.URL, "http://") {
+		atomic.StoreInt32(&bHealthy, 1)
+	} else {
+		atomic.StoreInt32(&aHealthy, 1)
+	}
+	h.checkAll(h.known())
+	if want, have := []string{healthy}, state(); !reflect.DeepEqual(want, have) {
+		t.Errorf("one healthy: want %v, have %v", want, have)
+	}
+}
+
+func TestHealthCheckerDeletesRemovedSeries(t *testing.T) {
+	var healthy int32 = 1
+	a := newHealthzServer(&healthy)
+	defer a.Close()
+	instance := strings.TrimPrefix(a.URL, "http://")
+
+	source := &fakeInstancer{}
+	healthyVec, checksVec := newHealthyVec(), newHealthChecksVec()
+	h, err := newHealthChecker(source, healthConfig{Interval: time.Hour, Timeout: time.Second, Rise: 1, Fall: 1}, healthyVec, checksVec, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	source.update(sd.Event{Instances: []string{instance}})
+	for deadline := time.Now().Add(2 * time.Second); series(checksVec) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no health checks recorded for %s", instance)
+		}
+	}
+	if series(healthyVec) != 1 {
+		t.Fatalf("want one healthy series, have %d", series(healthyVec))
+	}
+	source.update(sd.Event{Instances: []string{}})
+	if have := series(healthyVec) + series(checksVec); have != 0 {
+		t.Errorf("want no series after removal, have %d", have)
+	}
+}
+
+// fakeInstancer update 返回时订阅者已经处理完事件
+type fakeInstancer struct {
+	ch chan<- sd.Event
+}
+
+func (f *fakeInstancer) Register(ch chan<- sd.Event)   { f.ch = ch }
+func (f *fakeInstancer) Deregister(ch chan<- sd.Event) {}
+func (f *fakeInstancer) Stop()                         {}
+
+func (f *fakeInstancer) update(event sd.Event) {
+	f.ch <- event
+	f.ch <- event // 订阅者收到第二个事件时一定已经处理完第一个
+}
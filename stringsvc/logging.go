@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -17,7 +18,7 @@ type logmw struct {
 	next   StringService
 }
 
-func (mw logmw) Uppercase(s string) (output string, err error) {
+func (mw logmw) Uppercase(ctx context.Context, s string) (output string, err error) {
 	defer func(begin time.Time) {
 		_ = mw.logger.Log(
 			"method", "uppercase",
@@ -28,20 +29,21 @@ func (mw logmw) Uppercase(s string) (output string, err error) {
 		)
 	}(time.Now()) // now 是在函数定义的时候计算的
 
-	output, err = mw.next.Uppercase(s)
+	output, err = mw.next.Uppercase(ctx, s)
 	return
 }
 
-func (mw logmw) Count(s string) (n int) {
+func (mw logmw) Count(ctx context.Context, s string) (n int, err error) {
 	defer func(begin time.Time) {
 		_ = mw.logger.Log(
 			"method", "count",
 			"input", s,
 			"n", n,
+			"err", err,
 			"took", time.Since(begin),
 		)
 	}(time.Now()) // now 是在函数定义的时候计算的
 
-	n = mw.next.Count(s)
+	n, err = mw.next.Count(ctx, s)
 	return
 }
@@ -5,8 +5,12 @@ import (
 	"flag"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
 	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
 	httptransport "github.com/go-kit/kit/transport/http"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
@@ -15,8 +19,33 @@ import (
 
 func main() {
 	var (
-		listen = flag.String("listen", ":8080", "HTTP Listen Address")
-		proxy  = flag.String("proxy", "", "可选的用逗号分隔的链接，用于代理 uppercase 请求")
+		listen    = flag.String("listen", ":8080", "HTTP Listen Address")
+		proxy     = flag.String("proxy", "", "可选的用逗号分隔的链接，-proxy-methods 中的方法会代理到这些实例，链接中的路径是前缀，比如 host:8001/v1 的 uppercase 发到 host:8001/v1/uppercase")
+		proxyFile = flag.String("proxy-file", "", "可选的 JSON 或 YAML 实例列表文件，修改后不需要重启，优先于 -proxy-srv 和 -proxy")
+		proxySRV  = flag.String("proxy-srv", "", "可选的 DNS SRV 记录名，例如 Kubernetes headless service，优先于 -proxy")
+		refresh   = flag.Duration("proxy-srv-refresh", 30*time.Second, "重新查询 -proxy-srv 的间隔")
+		methods   = flag.String("proxy-methods", "uppercase", "用逗号分隔的需要代理的方法，可选 uppercase 和 count，其他方法在本地执行")
+		balancing = flag.String("lb", lbRoundRobin, "代理的负载均衡策略，可选 round-robin、least-outstanding、weighted-round-robin、peak-ewma 和 consistent-hash")
+		lbWeights = flag.String("lb-weights", "", "weighted-round-robin 使用的权重，格式为 host:port=3,host:port=1，没有指定的实例权重为 1")
+		fallback  = flag.Bool("count-fallback", false, "代理 count 失败时在本地执行，默认把错误返回给客户端，本地执行的次数记录在 proxy_count_fallbacks 中")
+		timeout   = flag.Duration("request-timeout", 0, "可选的每个请求的超时时间，代理请求的重试和 HTTP 客户端都受它限制，0 表示不限制")
+		hcEvery   = flag.Duration("health-interval", 0, "主动检查代理实例 /healthz 的间隔，0 表示不检查，所有实例都需要有 /healthz")
+		hcTimeout = flag.Duration("health-timeout", time.Second, "每次健康检查的超时时间")
+		hcRise    = flag.Int("health-rise", 2, "不健康的实例连续成功多少次后恢复")
+		hcFall    = flag.Int("health-fall", 2, "实例连续失败多少次后从负载均衡中摘除")
+		brkFails  = flag.Uint("breaker-failures", 6, "连续失败多少次后打开熔断器")
+		brkRatio  = flag.Float64("breaker-failure-ratio", 0, "失败率达到多少时打开熔断器，0 表示只看连续失败次数")
+		brkMinReq = flag.Uint("breaker-min-requests", 20, "按失败率打开熔断器之前至少需要的请求数")
+		brkReset  = flag.Duration("breaker-interval", 0, "熔断器关闭时清零计数的周期，0 表示不清零")
+		brkWait   = flag.Duration("breaker-timeout", 60*time.Second, "熔断器打开后多久进入半开状态")
+		brkProbes = flag.Uint("breaker-half-open-requests", 1, "半开状态下允许通过的请求数")
+		clRate    = flag.Float64("client-rate", 0, "每个客户端每秒允许的请求数，超过后返回 429，0 表示不限制")
+		clBurst   = flag.Int("client-burst", 20, "每个客户端最多可以连续发出的请求数")
+		clHeader  = flag.String("client-key-header", "X-API-Key", "用来区分客户端的请求头，值不在 -client-keys-file 中时使用客户端 IP")
+		clKeys    = flag.String("client-keys-file", "", "可选的 API key 文件，每行一个，只有其中的 key 会单独限流")
+		clIdle    = flag.Duration("client-idle", 5*time.Minute, "客户端多久没有请求后删除它的限流状态")
+		clMax     = flag.Int("client-max", 10000, "最多记录多少个客户端的限流状态，超过后删除最久没有请求的")
+		adminAddr = flag.String("admin-addr", "", "可选的管理接口地址，可以在运行时查看、添加、删除和排空代理的实例，/debug/breakers 查看熔断器，设置后即使没有实例也会启用代理")
 	)
 	flag.Parse()
 
@@ -42,10 +71,113 @@ func main() {
 		Name:      "count_result",
 		Help:      "The result of each count method",
 	}, []string{})
+	var countFallbacks metrics.Counter
+	if *fallback {
+		countFallbacks = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "my_group",
+			Subsystem: "string_service",
+			Name:      "proxy_count_fallbacks",
+			Help:      "Number of proxied count requests that failed and ran locally",
+		}, []string{})
+	}
+	// 实例下线时需要删除它的 series，所以下面几个直接使用 prometheus 的 Vec
+	breakerState := stdprometheus.NewGaugeVec(stdprometheus.GaugeOpts{
+		Namespace: "my_group",
+		Subsystem: "string_service",
+		Name:      "circuit_breaker_state",
+		Help:      "State of each proxied instance's circuit breaker, 0 closed, 1 half-open, 2 open",
+	}, []string{"instance", "method"})
+	upstreamHealthy := stdprometheus.NewGaugeVec(stdprometheus.GaugeOpts{
+		Namespace: "my_group",
+		Subsystem: "string_service",
+		Name:      "upstream_healthy",
+		Help:      "Whether each proxied instance passes health checks (1) or not (0)",
+	}, []string{"instance"})
+	healthChecks := stdprometheus.NewCounterVec(stdprometheus.CounterOpts{
+		Namespace: "my_group",
+		Subsystem: "string_service",
+		Name:      "upstream_health_checks",
+		Help:      "Number of health checks against each proxied instance",
+	}, []string{"instance", "result"})
+	stdprometheus.MustRegister(breakerState, upstreamHealthy, healthChecks)
 
 	var svc StringService
 	svc = stringService{}
-	svc = proxyingMiddleware(context.Background(), *proxy, logger)(svc)
+	instancer, err := proxyInstancer(proxyConfig{
+		Instances: *proxy,
+		File:      *proxyFile,
+		SRV:       *proxySRV,
+		Refresh:   *refresh,
+	}, logger)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	// stops 退出时按相反的顺序停止后台的 goroutine 和定时器
+	var stops []func()
+	if instancer != nil {
+		stops = append(stops, instancer.Stop)
+	}
+	proxied, err := parseProxyMethods(*methods)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	balancer, err := parseLBConfig(*balancing, *lbWeights)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	breakers, err := newBreakers(breakerConfig{
+		Failures:         uint32(*brkFails),
+		FailureRatio:     *brkRatio,
+		MinRequests:      uint32(*brkMinReq),
+		Interval:         *brkReset,
+		Timeout:          *brkWait,
+		HalfOpenRequests: uint32(*brkProbes),
+	}, breakerState, logger)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	var (
+		stats *proxyStats
+		admin *proxyAdmin
+	)
+	if *adminAddr != "" {
+		stats = newProxyStats()
+		admin = newProxyAdmin(instancer, stats, logger)
+		instancer = admin
+		stops = append(stops, admin.Stop)
+		// 管理接口只在 -admin-addr 上提供，不暴露给 -listen 上的客户端
+		mux := http.NewServeMux()
+		mux.Handle("/instances", admin)
+		mux.Handle("/instances/drain", admin)
+		mux.Handle("/debug/breakers", breakers)
+		go func() {
+			logger.Log("msg", "admin HTTP", "addr", *adminAddr)
+			logger.Log("err", http.ListenAndServe(*adminAddr, mux))
+		}()
+	}
+	// 健康检查在管理接口之后，被排空或删除的实例不再检查
+	if instancer != nil && *hcEvery > 0 {
+		health, err := newHealthChecker(instancer, healthConfig{
+			Interval: *hcEvery,
+			Timeout:  *hcTimeout,
+			Rise:     *hcRise,
+			Fall:     *hcFall,
+		}, upstreamHealthy, healthChecks, logger)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		if admin != nil {
+			admin.SetHealthChecker(health)
+		}
+		instancer = health
+		stops = append(stops, health.Stop)
+	}
+	svc = proxyingMiddleware(instancer, proxied, balancer, breakers, stats, countFallbacks, logger)(svc)
 	svc = loggingMiddleware(logger)(svc)
 	svc = instrumentingMiddleware{requestCount, requestLatency, countResult, svc}
 
@@ -61,9 +193,53 @@ func main() {
 		encodeResponse,
 	)
 
-	http.Handle("/uppercase", uppercaseHandler)
-	http.Handle("/count", countHandler)
+	limit := func(h http.Handler) http.Handler { return h }
+	if *clRate > 0 {
+		var keys map[string]bool
+		if *clKeys != "" {
+			if keys, err = loadClientKeys(*clKeys); err != nil {
+				logger.Log("err", err)
+				os.Exit(1)
+			}
+		}
+		limiter, err := newClientLimiter(clientLimitConfig{
+			Rate:   *clRate,
+			Burst:  *clBurst,
+			Header: *clHeader,
+			Keys:   keys,
+			Idle:   *clIdle,
+			Max:    *clMax,
+		})
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		limit = limiter.Wrap
+		stops = append(stops, limiter.Stop)
+	}
+
+	http.Handle("/uppercase", limit(withTimeout(*timeout, uppercaseHandler)))
+	http.Handle("/count", limit(withTimeout(*timeout, countHandler)))
 	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", healthHandler)
+
+	// 收到信号后等待已经收到的请求处理完，然后停止 stops 中的后台任务
+	server := &http.Server{Addr: *listen}
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		logger.Log("signal", <-c)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Log("during", "Shutdown", "err", err)
+		}
+	}()
 	logger.Log("msg", "HTTP", "addr", *listen)
-	logger.Log("err", http.ListenAndServe(*listen, nil))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Log("err", err)
+	}
+	for i := len(stops) - 1; i >= 0; i-- {
+		stops[i]()
+	}
 }
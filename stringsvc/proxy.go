@@ -4,23 +4,43 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"kitdemo/pkg/filesd"
+	"net"
 	"net/url"
 	"strings"
 	"time"
 
-	"github.com/go-kit/kit/circuitbreaker"
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
 	"github.com/go-kit/kit/ratelimit"
 	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/dnssrv"
 	"github.com/go-kit/kit/sd/lb"
 	httptransport "github.com/go-kit/kit/transport/http"
-	"github.com/sony/gobreaker"
 	"golang.org/x/time/rate"
 )
 
-func proxyingMiddleware(ctx context.Context, instances string, logger log.Logger) ServiceMiddleware {
-	if instances == "" {
+//proxyMethod 描述一个可以代理的方法，所有方法的请求都用 JSON 编码
+type proxyMethod struct {
+	path string
+	dec  httptransport.DecodeResponseFunc
+}
+
+//proxyMethods 所有可以代理的方法，key 是 -proxy-methods 中使用的名字，新的方法在这里添加后就可以代理
+var proxyMethods = map[string]proxyMethod{
+	"uppercase": {path: "/uppercase", dec: decodeUppercaseResponse},
+	"count":     {path: "/count", dec: decodeCountResponse},
+}
+
+//proxyingMiddleware methods 中的方法代理到 instancer 中的实例，其他方法在本地执行
+//每个方法有自己的 endpointer、负载均衡和重试，每个实例的每个方法有自己的熔断器和频率限制，负载均衡策略由 balancing 指定
+//熔断器由 breakers 创建，stats 不为 nil 时记录每个实例的请求数和熔断器状态，供管理接口查看
+//请求的 ctx 会传给 lb.Retry 和 HTTP 客户端，ctx 的截止时间早于 maxTime 时以 ctx 为准，调用方取消后上游的请求也会被取消
+//fallback 不为 nil 时 Count 代理失败后在本地执行并计数，为 nil 时返回错误，见 proxymw.Count
+func proxyingMiddleware(instancer sd.Instancer, methods []string, balancing lbConfig, breakers *breakers, stats *proxyStats, fallback metrics.Counter, logger log.Logger) ServiceMiddleware {
+	if instancer == nil || len(methods) == 0 {
 		logger.Log("proxy_to", "none")
 		return func(next StringService) StringService { return next }
 	}
@@ -31,41 +51,121 @@ func proxyingMiddleware(ctx context.Context, instances string, logger log.Logger
 		maxTime     = 250 * time.Millisecond
 	)
 
-	var (
-		instanceList = split(instances)
-		endpointer   sd.FixedEndpointer
-	)
-	logger.Log("proxy_to", fmt.Sprint(instanceList))
-	for _, instance := range instanceList {
-		var e endpoint.Endpoint
-		e = makeUppercaseProxy(ctx, instance)
-		// 熔断中间件
-		e = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(e)
-		// 频率限制中间件
-		e = ratelimit.NewErroringLimiter(rate.NewLimiter(rate.Every(time.Second), qps))(e)
-		endpointer = append(endpointer, e)
+	endpoints := map[string]endpoint.Endpoint{}
+	for _, name := range methods {
+		method := proxyMethods[name]
+		name := name
+		ups := &upstreams{}
+		// 实例列表变化时 endpointer 会调用 factory 为新的实例创建 endpoint
+		factory := func(instance string) (endpoint.Endpoint, io.Closer, error) {
+			e, err := makeProxy(instance, method)
+			if err != nil {
+				return nil, nil, err
+			}
+			// 熔断中间件
+			breaker, breakerMiddleware, breakerCloser := breakers.New(instance, name)
+			e = breakerMiddleware(e)
+			// 频率限制中间件
+			e = ratelimit.NewErroringLimiter(rate.NewLimiter(rate.Limit(qps), qps))(e)
+			e = stats.middleware(instance, name, breaker)(e)
+			return e, closers{ups.add(instance, e), breakerCloser}, nil
+		}
+		endpointer := sd.NewEndpointer(instancer, factory, log.With(logger, "proxy_to", "endpointer", "method", name))
+		balancer := newBalancer(balancing, endpointer, ups)
+		endpoints[name] = lb.Retry(maxAttempts, maxTime, balancer)
 	}
-
-	balancer := lb.NewRoundRobin(endpointer)
-	retry := lb.Retry(maxAttempts, maxTime, balancer)
+	logger.Log("proxy_methods", strings.Join(methods, ","), "lb", balancing.Strategy)
 
 	return func(next StringService) StringService {
-		return proxymw{ctx, next, retry}
+		return proxymw{next, endpoints, fallback, logger}
 	}
 }
 
+//parseProxyMethods 解析 -proxy-methods，不认识的方法返回错误
+func parseProxyMethods(s string) ([]string, error) {
+	var methods []string
+	for _, name := range split(s) {
+		if name == "" {
+			continue
+		}
+		if _, ok := proxyMethods[name]; !ok {
+			return nil, fmt.Errorf("unknown proxy method %q", name)
+		}
+		methods = append(methods, name)
+	}
+	return methods, nil
+}
+
+//proxyConfig 代理实例的来源，优先级依次是 File、SRV、Instances
+type proxyConfig struct {
+	Instances string
+	File      string
+	SRV       string
+	// Refresh 重新查询 SRV 记录的间隔
+	Refresh time.Duration
+	// Lookup 查询 SRV 记录的函数，一般是 net.LookupSRV，测试时可以替换成假的解析器
+	Lookup dnssrv.Lookup
+}
+
+//proxyInstancer 根据配置创建 instancer，File 修改后或者 SRV 记录变化后自动更新实例列表，都为空时不代理
+func proxyInstancer(c proxyConfig, logger log.Logger) (sd.Instancer, error) {
+	switch {
+	case c.File != "":
+		return filesd.NewInstancer(c.File, time.Second, logger)
+	case c.SRV != "":
+		if c.Refresh <= 0 {
+			return nil, fmt.Errorf("invalid SRV refresh interval %v", c.Refresh)
+		}
+		lookup := c.Lookup
+		if lookup == nil {
+			lookup = net.LookupSRV
+		}
+		logger.Log("proxy_to", c.SRV, "refresh", c.Refresh)
+		return dnssrv.NewInstancerDetailed(c.SRV, time.NewTicker(c.Refresh), lookup, log.With(logger, "instancer", "dnssrv")), nil
+	case c.Instances != "":
+		logger.Log("proxy_to", fmt.Sprint(split(c.Instances)))
+		return sd.FixedInstancer(split(c.Instances)), nil
+	default:
+		return nil, nil
+	}
+}
+
+//proxymw endpoints 中没有的方法在本地执行
 type proxymw struct {
-	ctx       context.Context
 	next      StringService
-	uppercase endpoint.Endpoint
+	endpoints map[string]endpoint.Endpoint
+	fallback  metrics.Counter
+	logger    log.Logger
 }
 
-func (mw proxymw) Count(s string) int {
-	return mw.next.Count(s)
+//Count 代理失败时和 Uppercase 一样把错误返回给客户端，设置了 fallback 时改为在本地执行
+func (mw proxymw) Count(ctx context.Context, s string) (int, error) {
+	e, ok := mw.endpoints["count"]
+	if !ok {
+		return mw.next.Count(ctx, s)
+	}
+	response, err := e(ctx, countRequest{S: s})
+	if err != nil {
+		if mw.fallback == nil {
+			return 0, err
+		}
+		mw.fallback.Add(1)
+		mw.logger.Log("method", "count", "proxy_err", err, "fallback", "local")
+		return mw.next.Count(ctx, s)
+	}
+	resp := response.(countResponse)
+	if resp.Err != "" {
+		return resp.V, errors.New(resp.Err)
+	}
+	return resp.V, nil
 }
 
-func (mw proxymw) Uppercase(s string) (string, error) {
-	response, err := mw.uppercase(mw.ctx, uppercaseRequest{S: s})
+func (mw proxymw) Uppercase(ctx context.Context, s string) (string, error) {
+	e, ok := mw.endpoints["uppercase"]
+	if !ok {
+		return mw.next.Uppercase(ctx, s)
+	}
+	response, err := e(ctx, uppercaseRequest{S: s})
 	if err != nil {
 		return "", err
 	}
@@ -76,24 +176,51 @@ func (mw proxymw) Uppercase(s string) (string, error) {
 	return resp.V, nil
 }
 
-func makeUppercaseProxy(ctx context.Context, instance string) endpoint.Endpoint {
-	if !strings.HasPrefix(instance, "http") {
-		instance = "http://" + instance
-	}
-	u, err := url.Parse(instance)
+//makeProxy instance 中的路径作为前缀，比如 host:8001/v1 会把 uppercase 发到 host:8001/v1/uppercase，见 instanceURL
+func makeProxy(instance string, method proxyMethod) (endpoint.Endpoint, error) {
+	u, err := instanceURL(instance, method.path)
 	if err != nil {
-		panic(err)
-	}
-	if u.Path == "" {
-		u.Path = "/uppercase"
+		return nil, err
 	}
 	// stringsvc 服务之间是通过 json 来编码的
 	return httptransport.NewClient(
 		"GET",
 		u,
 		encodeRequest,
-		decodeUppercaseResponse,
-	).Endpoint()
+		method.dec,
+	).Endpoint(), nil
+}
+
+// closers 实例下线时依次关闭
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	for _, c := range cs {
+		c.Close()
+	}
+	return nil
+}
+
+// instanceURL 返回 instance 上 path 的地址，instance 中没有协议时使用 http
+// instance 中的路径是前缀，以某个方法的路径结尾时先去掉它，兼容以前 -proxy host:8001/uppercase 的写法：
+// uppercase 仍然发到 host:8001/uppercase，count 发到 host:8001/count，而不是 host:8001/uppercase/uppercase
+func instanceURL(instance, path string) (*url.URL, error) {
+	if !strings.HasPrefix(instance, "http") {
+		instance = "http://" + instance
+	}
+	u, err := url.Parse(instance)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimSuffix(u.Path, "/")
+	for _, method := range proxyMethods {
+		if strings.HasSuffix(prefix, method.path) {
+			prefix = strings.TrimSuffix(prefix, method.path)
+			break
+		}
+	}
+	u.Path = prefix + path
+	return u, nil
 }
 
 func split(s string) []string {
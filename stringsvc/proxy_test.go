@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/sd"
+)
+
+// fakeResolver 代替 net.LookupSRV，返回的记录可以在测试中修改
+type fakeResolver struct {
+	mtx     sync.Mutex
+	names   []string
+	records []*net.SRV
+	err     error
+}
+
+func (r *fakeResolver) lookup(service, proto, name string) (string, []*net.SRV, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.names = append(r.names, name)
+	return name, r.records, r.err
+}
+
+func (r *fakeResolver) set(err error, servers ...*httptest.Server) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.records, r.err = nil, err
+	for _, s := range servers {
+		host, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+		p, _ := strconv.Atoi(port)
+		r.records = append(r.records, &net.SRV{Target: host, Port: uint16(p)})
+	}
+}
+
+// newUppercaseServer 返回一个 uppercase 的结果总是 name 的实例
+func newUppercaseServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodeResponse(r.Context(), w, uppercaseResponse{V: name})
+	}))
+}
+
+func TestProxySRVDiscovery(t *testing.T) {
+	a, b := newUppercaseServer("A"), newUppercaseServer("B")
+	defer a.Close()
+	defer b.Close()
+	resolver := &fakeResolver{}
+	resolver.set(nil, a)
+
+	logger := log.NewNopLogger()
+	instancer, err := proxyInstancer(proxyConfig{
+		SRV:     "stringsvc.default.svc.cluster.local",
+		Refresh: 10 * time.Millisecond,
+		Lookup:  resolver.lookup,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+	breakers, err := newBreakers(breakerConfig{}, newBreakerStateVec(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := proxyingMiddleware(instancer, []string{"uppercase"}, lbConfig{Strategy: lbRoundRobin}, breakers, nil, nil, logger)(stringService{})
+
+	// eventually 等待代理的结果变成 want，服务发现的更新是异步的
+	eventually := func(want string) {
+		t.Helper()
+		var have string
+		var err error
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if have, err = svc.Uppercase(context.Background(), "x"); err == nil && have == want {
+				return
+			}
+		}
+		t.Fatalf("want %q, have %q, %v", want, have, err)
+	}
+	eventually("A")
+
+	resolver.set(nil, b)
+	eventually("B")
+
+	// 查询出错时继续使用上一次的实例
+	resolver.set(errors.New("no such host"))
+	time.Sleep(50 * time.Millisecond)
+	eventually("B")
+
+	resolver.mtx.Lock()
+	defer resolver.mtx.Unlock()
+	for _, name := range resolver.names {
+		if name != "stringsvc.default.svc.cluster.local" {
+			t.Errorf("looked up %q", name)
+		}
+	}
+}
+
+func TestProxyInstancerInvalidRefresh(t *testing.T) {
+	if _, err := proxyInstancer(proxyConfig{SRV: "stringsvc", Lookup: (&fakeResolver{}).lookup}, log.NewNopLogger()); err == nil {
+		t.Error("want error for zero refresh interval")
+	}
+}
+
+func TestInstanceURL(t *testing.T) {
+	for _, tc := range []struct {
+		instance, path, want string
+	}{
+		{"localhost:8001", "/uppercase", "http://localhost:8001/uppercase"},
+		{"localhost:8001/", "/count", "http://localhost:8001/count"},
+		{"https://host:8001/v1", "/uppercase", "https://host:8001/v1/uppercase"},
+		{"host:8001/v1/", "/healthz", "http://host:8001/v1/healthz"},
+		// 以前的写法，路径就是 uppercase 的地址
+		{"localhost:8001/uppercase", "/uppercase", "http://localhost:8001/uppercase"},
+		{"localhost:8001/uppercase", "/count", "http://localhost:8001/count"},
+		{"host:8001/v1/count", "/healthz", "http://host:8001/v1/healthz"},
+		{"host:8001/v1/xuppercase", "/count", "http://host:8001/v1/xuppercase/count"},
+	} {
+		u, err := instanceURL(tc.instance, tc.path)
+		if err != nil {
+			t.Errorf("%s: %v", tc.instance, err)
+			continue
+		}
+		if have := u.String(); have != tc.want {
+			t.Errorf("instanceURL(%q, %q): want %q, have %q", tc.instance, tc.path, tc.want, have)
+		}
+	}
+}
+
+func TestProxyCountFallback(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	logger := log.NewNopLogger()
+	breakers, err := newBreakers(breakerConfig{}, newBreakerStateVec(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instancer := sd.FixedInstancer{down.Listener.Addr().String()}
+
+	// 默认不在本地执行，错误返回给调用方
+	svc := proxyingMiddleware(instancer, []string{"count"}, lbConfig{Strategy: lbRoundRobin}, breakers, nil, nil, logger)(stringService{})
+	if v, err := svc.Count(context.Background(), "abc"); err == nil {
+		t.Errorf("without fallback: want an error, have %d", v)
+	}
+	// 和 uppercase 一样，错误放在响应的 err 中返回给客户端
+	if response, err := makeCountEndpoint(svc)(context.Background(), countRequest{S: "abc"}); err != nil || response.(countResponse).Err == "" {
+		t.Errorf("count endpoint: want err in the response, have %+v, %v", response, err)
+	}
+
+	fallbacks := &fakeCounter{}
+	svc = proxyingMiddleware(instancer, []string{"count"}, lbConfig{Strategy: lbRoundRobin}, breakers, nil, fallbacks, logger)(stringService{})
+	if v, err := svc.Count(context.Background(), "abc"); err != nil || v != 3 {
+		t.Errorf("with fallback: want 3, have %d, %v", v, err)
+	}
+	if want, have := 1.0, fallbacks.value; want != have {
+		t.Errorf("fallbacks: want %v, have %v", want, have)
+	}
+}
+
+// fakeCounter 只在一个 goroutine 中使用
+type fakeCounter struct {
+	value float64
+}
+
+func (c *fakeCounter) With(...string) metrics.Counter { return c }
+func (c *fakeCounter) Add(delta float64)              { c.value += delta }
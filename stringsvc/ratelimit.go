@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//clientLimitConfig 入站请求按客户端限流的配置
+type clientLimitConfig struct {
+	// Rate 每个客户端每秒补充的请求数，Burst 是最多可以连续发出的请求数
+	Rate  float64
+	Burst int
+	// Header 中的值在 Keys 中时用它作为客户端的 key，否则使用客户端的 IP
+	// 请求头可以随意伪造，不检查的话每次换一个值就能得到一个新的令牌桶
+	Header string
+	Keys   map[string]bool
+	// Idle 客户端多久没有请求后删除它的令牌桶
+	Idle time.Duration
+	// Max 最多保存多少个客户端的令牌桶，超过后删除最久没有请求的
+	Max int
+}
+
+//clientLimiter 每个客户端一个令牌桶，超过限制的请求返回 429，所有响应都带有 X-RateLimit-* 头
+type clientLimiter struct {
+	config clientLimitConfig
+	quit   chan struct{}
+
+	mtx     sync.Mutex
+	buckets map[string]*list.Element
+	// lru 最近有请求的令牌桶在前面
+	lru *list.List
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+//loadClientKeys 读取 API key 文件，每行一个 key，忽略空行和 # 开头的行
+func loadClientKeys(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys[line] = true
+	}
+	return keys, scanner.Err()
+}
+
+//newClientLimiter 启动一个定期删除空闲令牌桶的 goroutine，空闲的桶已经是满的，删除后不影响限流
+func newClientLimiter(config clientLimitConfig) (*clientLimiter, error) {
+	if config.Rate <= 0 || config.Burst <= 0 || config.Idle <= 0 || config.Max <= 0 {
+		return nil, fmt.Errorf("invalid client rate limit config %+v", config)
+	}
+	l := &clientLimiter{
+		config:  config,
+		quit:    make(chan struct{}),
+		buckets: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+	go l.evictLoop()
+	return l, nil
+}
+
+func (l *clientLimiter) evictLoop() {
+	ticker := time.NewTicker(l.config.Idle)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			l.evict(now)
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+func (l *clientLimiter) evict(now time.Time) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for e := l.lru.Back(); e != nil; e = l.lru.Back() {
+		if now.Sub(e.Value.(*bucket).last) < l.config.Idle {
+			return
+		}
+		l.remove(e)
+	}
+}
+
+func (l *clientLimiter) remove(e *list.Element) {
+	l.lru.Remove(e)
+	delete(l.buckets, e.Value.(*bucket).key)
+}
+
+//Stop 停止删除空闲令牌桶
+func (l *clientLimiter) Stop() {
+	close(l.quit)
+}
+
+// take 从 key 的令牌桶中取一个令牌，返回剩余的令牌数、桶装满还需要的时间，不允许时返回需要等待的时间
+func (l *clientLimiter) take(key string, now time.Time) (ok bool, remaining float64, reset, wait time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	burst := float64(l.config.Burst)
+	e, found := l.buckets[key]
+	if found {
+		l.lru.MoveToFront(e)
+	} else {
+		if l.lru.Len() >= l.config.Max {
+			l.remove(l.lru.Back())
+		}
+		e = l.lru.PushFront(&bucket{key: key, tokens: burst, last: now})
+		l.buckets[key] = e
+	}
+	b := e.Value.(*bucket)
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.config.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		wait = l.seconds(1 - b.tokens)
+	}
+	return ok, b.tokens, l.seconds(burst - b.tokens), wait
+}
+
+// seconds 补充 tokens 个令牌需要的时间
+func (l *clientLimiter) seconds(tokens float64) time.Duration {
+	return time.Duration(tokens / l.config.Rate * float64(time.Second))
+}
+
+// key 已知的 API key 优先，两种 key 加上不同的前缀，避免 API key 和 IP 相同时共用一个桶
+func (l *clientLimiter) key(r *http.Request) string {
+	if l.config.Header != "" {
+		if v := r.Header.Get(l.config.Header); v != "" && l.config.Keys[v] {
+			return "key:" + v
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+//Wrap 对 h 的请求按客户端限流
+func (l *clientLimiter) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, remaining, reset, wait := l.take(l.key(r), time.Now())
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(l.config.Burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(remaining)))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"err":"rate limit exceeded"}` + "\n"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ceilSeconds Retry-After 只能是整数秒，向上取整保证客户端等待后一定有令牌
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"strings"
 )
 
+//StringService ctx 携带请求的截止时间和取消信号，代理到其他实例时会一直传递到 HTTP 客户端
+//本地的 Count 不会出错，代理到其他实例时可能失败，所以也返回 error
 type StringService interface {
-	Uppercase(string) (string, error)
-	Count(string) int
+	Uppercase(ctx context.Context, s string) (string, error)
+	Count(ctx context.Context, s string) (int, error)
 }
 
 var ErrEmpty = errors.New("empty string")
@@ -15,7 +18,7 @@ var ErrEmpty = errors.New("empty string")
 type stringService struct {
 }
 
-func (stringService) Uppercase(s string) (string, error) {
+func (stringService) Uppercase(_ context.Context, s string) (string, error) {
 	if s == "" {
 		return "", ErrEmpty
 	}
@@ -23,8 +26,8 @@ func (stringService) Uppercase(s string) (string, error) {
 	return strings.ToUpper(s), nil
 }
 
-func (stringService) Count(s string) int {
-	return len(s)
+func (stringService) Count(_ context.Context, s string) (int, error) {
+	return len(s), nil
 }
 
 type ServiceMiddleware func(StringService) StringService
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/go-kit/kit/endpoint"
 )
@@ -24,13 +25,14 @@ type countRequest struct {
 }
 
 type countResponse struct {
-	V int `json:"v"`
+	V   int    `json:"v"`
+	Err string `json:"err,omitempty"`
 }
 
 func makeUppercaseEndpoint(svc StringService) endpoint.Endpoint {
-	return func(_ context.Context, request interface{}) (interface{}, error) {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(uppercaseRequest)
-		v, err := svc.Uppercase(req.S)
+		v, err := svc.Uppercase(ctx, req.S)
 		if err != nil {
 			return uppercaseResponse{v, err.Error()}, nil
 		}
@@ -39,11 +41,26 @@ func makeUppercaseEndpoint(svc StringService) endpoint.Endpoint {
 }
 
 func makeCountEndpoint(svc StringService) endpoint.Endpoint {
-	return func(_ context.Context, request interface{}) (interface{}, error) {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(countRequest)
-		v := svc.Count(req.S)
-		return countResponse{v}, nil
+		v, err := svc.Count(ctx, req.S)
+		if err != nil {
+			return countResponse{v, err.Error()}, nil
+		}
+		return countResponse{v, ""}, nil
+	}
+}
+
+//withTimeout 给每个请求的 ctx 加上截止时间，客户端断开连接时 ctx 也会被取消，d 为 0 时不限制
+func withTimeout(d time.Duration, h http.Handler) http.Handler {
+	if d <= 0 {
+		return h
 	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
 func decodeUppercaseRequest(_ context.Context, r *http.Request) (interface{}, error) {
@@ -70,6 +87,14 @@ func decodeCountRequest(_ context.Context, r *http.Request) (interface{}, error)
 	return request, nil
 }
 
+func decodeCountResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	var response countResponse
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
 func encodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
 	return json.NewEncoder(w).Encode(response)
 }